@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+)
+
+const esc = 0x1b
+
+// stripAnsi removes ANSI/VT100 escape sequences and resolves carriage-return
+// redraws so only the final state of each line remains.
+//
+// Handled sequences:
+//   - CSI: ESC [ params intermediates final (colors, cursor movement, erase)
+//   - OSC: ESC ] ... terminated by BEL or ESC \ (titles, OSC 8 hyperlinks —
+//     the link text is kept, the URL is dropped)
+//   - DCS / SOS / PM / APC: ESC P|X|^|_ ... ESC \
+//   - Two-byte escapes such as ESC ( B or ESC =
+func stripAnsi(s string) string {
+	if strings.IndexByte(s, esc) < 0 && strings.IndexByte(s, '\r') < 0 {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c != esc {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 >= len(s) {
+			break
+		}
+		switch s[i+1] {
+		case '[':
+			i = skipCSI(s, i+2)
+		case ']', 'P', 'X', '^', '_':
+			i = skipString(s, i+2)
+		default:
+			i = skipEscape(s, i+1)
+		}
+	}
+
+	return resolveCarriageReturns(b.String())
+}
+
+// skipCSI returns the index just past a CSI sequence whose parameters start at i.
+func skipCSI(s string, i int) int {
+	for i < len(s) {
+		c := s[i]
+		i++
+		if c >= 0x40 && c <= 0x7e {
+			return i
+		}
+	}
+	return i
+}
+
+// skipString returns the index just past a string-type sequence (OSC, DCS, ...)
+// whose payload starts at i. Terminated by BEL or ST (ESC \).
+func skipString(s string, i int) int {
+	for i < len(s) {
+		switch s[i] {
+		case 0x07:
+			return i + 1
+		case esc:
+			if i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+			return i
+		}
+		i++
+	}
+	return i
+}
+
+// skipEscape returns the index just past a non-CSI escape sequence whose first
+// byte after ESC is at i: any intermediates (0x20–0x2F) followed by a final byte.
+func skipEscape(s string, i int) int {
+	for i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f {
+		i++
+	}
+	if i < len(s) {
+		i++
+	}
+	return i
+}
+
+// resolveCarriageReturns keeps only the text after the last \r on each line,
+// which is what a terminal would show after a progress bar redraw. A trailing
+// \r (CRLF line endings) is treated as part of the line terminator.
+func resolveCarriageReturns(s string) string {
+	if strings.IndexByte(s, '\r') < 0 {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if idx := strings.LastIndexByte(line, '\r'); idx >= 0 {
+			line = line[idx+1:]
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
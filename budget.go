@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultImportant matches lines that survive a token budget first.
+var defaultImportant = []string{
+	`(?i)\b(error|errors|err|fail|failed|failure|failing|fatal|panic|exception|warning|warn)\b`,
+}
+
+// budgetMarkerTokens is what an omission marker is assumed to cost while
+// choosing lines; the real cost is a few tokens less.
+const budgetMarkerTokens = 16
+
+// applyTokenBudget trims output to at most maxTokens tokens (estimateTokens).
+// Lines matching an important pattern are kept first, then lines closest to
+// the start and end of the output, which usually hold the headline and the
+// summary. Each run of dropped lines is replaced by an "… N lines / M tokens
+// omitted …" marker. maxTokens <= 0 means no limit.
+func applyTokenBudget(output string, maxTokens int, important []string) string {
+	if maxTokens <= 0 || estimateTokens(output) <= maxTokens {
+		return output
+	}
+	trailingNewline := strings.HasSuffix(output, "\n")
+	lines := splitLines(output)
+	if len(lines) == 0 {
+		return output
+	}
+
+	costs := make([]int, len(lines))
+	for i, line := range lines {
+		costs[i] = estimateTokens(line + "\n")
+	}
+
+	// Rank: important lines in order, then the rest from the edges inwards
+	regexes := compilePatterns(important)
+	var ranked, rest []int
+	for i, line := range lines {
+		if matchesAny(regexes, line) {
+			ranked = append(ranked, i)
+		} else {
+			rest = append(rest, i)
+		}
+	}
+	sort.SliceStable(rest, func(a, b int) bool {
+		return edgeDistance(rest[a], len(lines)) < edgeDistance(rest[b], len(lines))
+	})
+	ranked = append(ranked, rest...)
+
+	// Greedy fill. Everything starts omitted, as one gap with one marker.
+	kept := make([]bool, len(lines))
+	total := budgetMarkerTokens
+	anyKept := false
+	for _, i := range ranked {
+		cost := costs[i] + gapDelta(kept, i)*budgetMarkerTokens
+		if total+cost > maxTokens {
+			continue
+		}
+		kept[i] = true
+		total += cost
+		anyKept = true
+	}
+
+	// Nothing fits whole (e.g. one huge minified line): keep a prefix of the
+	// best-ranked line instead of returning only a marker.
+	if !anyKept {
+		i := ranked[0]
+		room := maxTokens - 2*budgetMarkerTokens
+		if room < 1 {
+			room = 1
+		}
+		lines[i] = truncateToTokens(lines[i], room)
+		kept[i] = true
+	}
+
+	var out []string
+	for i := 0; i < len(lines); {
+		if kept[i] {
+			out = append(out, lines[i])
+			i++
+			continue
+		}
+		n, tok := 0, 0
+		for ; i < len(lines) && !kept[i]; i++ {
+			n++
+			tok += costs[i]
+		}
+		out = append(out, omittedMarker(n, tok))
+	}
+	if !anyKept {
+		out = append(out, "… line truncated …")
+	}
+
+	result := strings.Join(out, "\n")
+	if trailingNewline {
+		result += "\n"
+	}
+	return result
+}
+
+// edgeDistance is how far line i is from the nearer end of n lines.
+func edgeDistance(i, n int) int {
+	return min(i, n-1-i)
+}
+
+// gapDelta is how the number of omission markers changes if line i, which
+// is currently omitted, gets kept: it splits its gap in two (+1), removes a
+// one-line gap (-1), or shortens a gap (0).
+func gapDelta(kept []bool, i int) int {
+	leftOmitted := i > 0 && !kept[i-1]
+	rightOmitted := i < len(kept)-1 && !kept[i+1]
+	switch {
+	case leftOmitted && rightOmitted:
+		return 1
+	case !leftOmitted && !rightOmitted:
+		return -1
+	}
+	return 0
+}
+
+func omittedMarker(lines, tokens int) string {
+	return fmt.Sprintf("… %s / %d tokens omitted …", plural(lines, "line"), tokens)
+}
+
+// isOmittedMarker recognizes the lines that stand for omitted ones: budget
+// and section markers ("… N lines omitted …") and the "… N more" of [json],
+// [table] and diagnostics.
+func isOmittedMarker(line string) bool {
+	return strings.HasPrefix(line, "… ") &&
+		(strings.HasSuffix(line, " omitted …") || moreMarkerRe.MatchString(line))
+}
+
+var moreMarkerRe = regexp.MustCompile(`^… \d+ more( rows?| in .+)?$`)
+
+// truncateToTokens returns the longest prefix of s (on a rune boundary) that
+// fits in maxTokens.
+func truncateToTokens(s string, maxTokens int) string {
+	lo, hi := 0, len(s)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if estimateTokens(s[:mid]) <= maxTokens {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	for lo > 0 && lo < len(s) && !utf8.RuneStart(s[lo]) {
+		lo--
+	}
+	return s[:lo]
+}
+
+// importantPatterns returns the filter's important patterns, or the defaults.
+func importantPatterns(f *Filter) []string {
+	if f != nil && len(f.Important) > 0 {
+		return f.Important
+	}
+	return defaultImportant
+}
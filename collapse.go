@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lineGroup is a run of equivalent lines, reported once at the position of
+// the first one.
+type lineGroup struct {
+	first string // the first line as it appeared
+	text  string // what to print when the group has more than one line
+	count int
+}
+
+func (g *lineGroup) String() string {
+	if g.count == 1 {
+		return g.first
+	}
+	return fmt.Sprintf("%s (×%d)", g.text, g.count)
+}
+
+// groupLines merges lines that share a key, anywhere in the output. key
+// returns the group key and its display text, or ok=false for lines that
+// pass through untouched.
+func groupLines(lines []string, key func(string) (k, text string, ok bool)) []string {
+	groups := make(map[string]*lineGroup)
+	order := make([]*lineGroup, 0, len(lines))
+	for _, line := range lines {
+		k, text, ok := key(line)
+		if !ok {
+			order = append(order, &lineGroup{first: line, count: 1})
+			continue
+		}
+		if g, seen := groups[k]; seen {
+			g.count++
+			continue
+		}
+		g := &lineGroup{first: line, text: text, count: 1}
+		groups[k] = g
+		order = append(order, g)
+	}
+
+	out := make([]string, len(order))
+	for i, g := range order {
+		out[i] = g.String()
+	}
+	return out
+}
+
+// applyCollapse groups lines that render to the same template under the
+// first matching rule, e.g. "warning: unused variable `x`" and "... `y`"
+// with output = "warning: unused variable" become
+// "warning: unused variable (×2)". A group of one keeps its original line.
+func applyCollapse(lines []string, rules []ReplaceRule) []string {
+	compiled := compileReplaceRules(rules)
+	return groupLines(lines, func(line string) (string, string, bool) {
+		return collapseKey(compiled, line)
+	})
+}
+
+func collapseKey(compiled []compiledReplace, line string) (string, string, bool) {
+	for _, cr := range compiled {
+		if m := cr.re.FindStringSubmatch(line); m != nil {
+			text := cr.output.render(matchVars(cr.re, m))
+			return text, text, true
+		}
+	}
+	return "", "", false
+}
+
+// applyDedupe reports each distinct line once, with a count when repeated.
+// Blank lines are left alone since they usually separate sections.
+func applyDedupe(lines []string) []string {
+	return groupLines(lines, dedupeKey)
+}
+
+func dedupeKey(line string) (string, string, bool) {
+	if strings.TrimSpace(line) == "" {
+		return "", "", false
+	}
+	return line, line, true
+}
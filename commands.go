@@ -6,8 +6,11 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func cmdRun(args []string) {
@@ -16,6 +19,40 @@ func cmdRun(args []string) {
 		os.Exit(1)
 	}
 
+	// Options come before the command: rt run --timeout 30s [--] <cmd...>
+	var timeout time.Duration
+	trace, sideBySide := false, false
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") && args[0] != "--" {
+		if args[0] == "--trace" || args[0] == "--side-by-side" {
+			trace = true
+			sideBySide = sideBySide || args[0] == "--side-by-side"
+			args = args[1:]
+			continue
+		}
+		if !strings.HasPrefix(args[0], "--timeout") {
+			break
+		}
+		value, ok := strings.CutPrefix(args[0], "--timeout=")
+		if !ok {
+			if args[0] != "--timeout" || len(args) < 2 {
+				break
+			}
+			value = args[1]
+			args = args[1:]
+		}
+		d, err := parseTimeout(value)
+		if err != nil || d <= 0 {
+			fmt.Fprintf(os.Stderr, "rt: invalid --timeout %q\n", value)
+			os.Exit(1)
+		}
+		timeout = d
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "rt: usage: rt run [--timeout <dur>] [--trace [--side-by-side]] <command...>")
+		os.Exit(1)
+	}
+
 	// If first arg is "--", treat the rest as a single shell string (passthrough mode).
 	// This preserves pipes, redirections, &&, etc.
 	shellMode := false
@@ -23,6 +60,10 @@ func cmdRun(args []string) {
 		args = args[1:]
 		shellMode = true
 	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "rt: usage: rt run <command...>")
+		os.Exit(1)
+	}
 
 	cmdStr := strings.Join(args, " ")
 
@@ -33,47 +74,273 @@ func cmdRun(args []string) {
 	}
 
 	f := matchFilter(filters, cmdStr)
+	matched := f
+
+	// Resolve [[variant]] delegation against the command's real working directory
+	vctx := newVariantContext(cmdStr)
+	workDir = vctx.Dir
+	if f != nil {
+		f = resolveVariant(filters, f, vctx)
+	}
+	warnFilterProblems(f)
 
 	// Determine what command to actually execute
-	var result runResult
+	runCmd, override := "", false
 	if f != nil && f.Run != "" {
+		// The words of the matched segment: the arguments themselves unless
+		// the command is a shell string or a chain
+		matchCmd := extractMatchCmd(cmdStr)
+		words := args
+		if shellMode || matchCmd != cmdStr {
+			words = shellSplit(matchCmd)
+		}
+		pattern, score := bestPattern(f, matchCmd)
+		if score < 0 {
+			// A variant reached through detection rather than its command
+			pattern, _ = bestPattern(matched, matchCmd)
+		}
+		runCmd, override = runOverride(f, pattern, words)
+	}
+	var cmd *exec.Cmd
+	if override {
 		// If the command has chain operators, preserve the setup prefix
 		// and only replace the last segment with the filter's run command.
-		// e.g. "cd /tmp && git status" + run="git status --porcelain -b"
+		// e.g. "cd /tmp && git status" + run="git status --porcelain -b {args}"
 		//    → "cd /tmp && git status --porcelain -b"
-		runCmd := f.Run
 		if prefix := chainPrefix(cmdStr); prefix != "" {
 			runCmd = prefix + runCmd
 		}
-		result = runCommand(runCmd)
+		cmd = shellCommand(runCmd)
 	} else if shellMode || f == nil {
 		// Passthrough or explicit shell mode: use sh -c to preserve pipes, redirections, etc.
-		result = runCommand(cmdStr)
+		cmd = shellCommand(cmdStr)
 	} else {
-		result = runCommandFromArgs(args)
+		cmd = argsCommand(args)
 	}
 
+	// --timeout wins over the filter's own timeout
+	if timeout == 0 && f != nil {
+		timeout = time.Duration(f.Timeout)
+	}
+
+	// Streaming filters print lines as they arrive instead of after exit;
+	// a trace needs the whole output
+	if f != nil && f.Stream && !trace {
+		runStreaming(f, cmdStr, cmd, timeout)
+		return
+	}
+
+	result := execute(cmd, timeout, f != nil && f.splitsStreams())
+
 	// No filter matched — passthrough
 	if f == nil {
-		if result.ExitCode != 0 {
-			fmt.Fprintf(os.Stdout, "Error: Exit code %d\n", result.ExitCode)
+		if trace {
+			fmt.Fprintf(os.Stderr, "rt: no filter matches %q; nothing to trace\n", cmdStr)
+		}
+		cfg := loadConfig()
+		output := result.Output
+		if cfg.StripAnsi {
+			output = stripAnsi(output)
+		}
+		// Long output of unknown commands is mostly repeated log lines
+		lines := splitLines(output)
+		mined := cfg.LogTemplates.applies(len(lines))
+		if mined {
+			output = strings.Join(mineLogTemplates(lines, defaultImportant), "\n") + "\n"
+		}
+		output = applyTokenBudget(output, cfg.MaxTokens, defaultImportant)
+		printExitStatus(result, timeout)
+		fmt.Print(output)
+		id := recordRun("passthrough", cmdStr, result.Output, output)
+		stored := saveRun(id, result.Output, output)
+		if !stored {
+			id = 0
+		}
+		if mined {
+			if hint := hiddenHint(len(lines), countShownLines(output), id); hint != "" {
+				fmt.Println(hint)
+			}
 		}
-		fmt.Print(result.Output)
-		recordRun("passthrough", cmdStr, result.Output, result.Output)
 		return
 	}
 
-	filtered := applyFilter(f, result.Output, result.ExitCode)
+	// Variants can also look at the output (detect.output_contains)
+	if v := resolveAfterRun(filters, matched, vctx, result.Output); v != f {
+		f = v
+		warnFilterProblems(f)
+	}
 
-	if result.ExitCode != 0 {
-		fmt.Fprintf(os.Stdout, "Error: Exit code %d\n", result.ExitCode)
+	var tr *pipelineTrace
+	if trace {
+		tr = newPipelineTrace()
+	}
+	filtered := applyFilterTraced(f, result, tr)
+	if max := loadConfig().MaxTokens; f.MaxTokens == 0 && max > 0 {
+		done := tr.begin("max_tokens", splitLines(filtered), nil)
+		filtered = applyTokenBudget(filtered, max, importantPatterns(f))
+		done(splitLines(filtered))
+	}
+	if trace {
+		printExitStatus(result, timeout)
+		printTrace(tr, filtered, sideBySide)
+		saveRun(recordRun(f.Name, cmdStr, result.Output, filtered), result.Output, filtered)
+		return
+	}
+
+	printExitStatus(result, timeout)
+	fmt.Print(filtered)
+	if filtered != "" && !strings.HasSuffix(filtered, "\n") {
+		fmt.Println()
+	}
+
+	// Keep the unfiltered output so dropped lines can be recovered without
+	// re-running the command (rt raw <id>)
+	id := recordRun(f.Name, cmdStr, result.Output, filtered)
+	stored := saveRun(id, result.Output, filtered)
+	if !stored {
+		id = 0
+	}
+	if hint := hiddenHint(len(splitLines(result.Output)), countShownLines(filtered), id); hint != "" {
+		fmt.Println(hint)
+	}
+}
+
+// cmdFilter applies a filter to output that was already captured, read
+// from a file or stdin: rt filter <filter | file.toml> [--exit-code N] [file],
+// or rt filter --as "<command>" [...] to pick the filter the command would get.
+func cmdFilter(args []string) {
+	usage := "rt: usage: rt filter <filter | file.toml> [--exit-code N] [file]\n       rt filter --as \"<command>\" [--exit-code N] [file]"
+	exitCode := 0
+	as := ""
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		if name != "--exit-code" && name != "--as" {
+			positional = append(positional, args[i])
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, usage)
+				os.Exit(1)
+			}
+			i++
+			value = args[i]
+		}
+		if name == "--as" {
+			as = value
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rt: invalid --exit-code %q\n", value)
+			os.Exit(1)
+		}
+		exitCode = n
+	}
+	if as == "" && len(positional) == 0 || len(positional) > 2 || as != "" && len(positional) > 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	var f *Filter
+	if as == "" {
+		f = loadFilterArg(positional[0])
+		positional = positional[1:]
+	}
+	var data []byte
+	var err error
+	if len(positional) == 1 {
+		data, err = os.ReadFile(positional[0])
+	} else {
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rt: %v\n", err)
+		os.Exit(1)
+	}
+	raw := string(data)
+
+	if as != "" {
+		filters, err := loadFiltersWithCache()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rt: error loading filters: %v\n", err)
+			os.Exit(1)
+		}
+		if f = matchFilter(filters, as); f != nil {
+			vctx := newVariantContext(as)
+			workDir = vctx.Dir
+			f = resolveAfterRun(filters, f, vctx, raw)
+			warnFilterProblems(f)
+		}
+	}
+
+	// No filter for the command: print the output as it is
+	if f == nil {
+		fmt.Print(raw)
+		return
+	}
+
+	filtered := applyFilterResult(f, textResult(raw, exitCode))
+	if max := loadConfig().MaxTokens; f.MaxTokens == 0 && max > 0 {
+		filtered = applyTokenBudget(filtered, max, importantPatterns(f))
 	}
 	fmt.Print(filtered)
 	if filtered != "" && !strings.HasSuffix(filtered, "\n") {
 		fmt.Println()
 	}
 
-	recordRun(f.Name, cmdStr, result.Output, filtered)
+	command := as
+	if command == "" {
+		command = "rt filter " + f.Name
+	}
+	id := recordRun(f.Name, command, raw, filtered)
+	if !saveRun(id, raw, filtered) {
+		id = 0
+	}
+	if hint := hiddenHint(len(splitLines(raw)), countShownLines(filtered), id); hint != "" {
+		fmt.Println(hint)
+	}
+}
+
+// loadFilterArg returns the filter named name, or the filter in the file
+// name when it ends in .toml. It exits when there is none.
+func loadFilterArg(name string) *Filter {
+	if strings.HasSuffix(name, ".toml") {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rt: %v\n", err)
+			os.Exit(1)
+		}
+		f, err := parseFilter(data, toFilterName(filepath.Base(name)), "file", name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rt: invalid filter: %s\n", describeDecodeError(name, err))
+			os.Exit(1)
+		}
+		warnFilterProblems(&f)
+		return &f
+	}
+	filters, err := loadFiltersWithCache()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rt: error loading filters: %v\n", err)
+		os.Exit(1)
+	}
+	f := findFilter(filters, name)
+	if f == nil {
+		fmt.Fprintf(os.Stderr, "rt: filter not found: %s\n", name)
+		os.Exit(1)
+	}
+	warnFilterProblems(f)
+	return f
+}
+
+// printExitStatus prints the banner that precedes the output of a failed run.
+func printExitStatus(result runResult, timeout time.Duration) {
+	if result.TimedOut {
+		fmt.Fprintf(os.Stdout, "Error: Timed out after %s (exit code %d)\n", formatTimeout(timeout), result.ExitCode)
+	} else if result.ExitCode != 0 {
+		fmt.Fprintf(os.Stdout, "Error: Exit code %d\n", result.ExitCode)
+	}
 }
 
 func cmdLs() {
@@ -90,6 +357,69 @@ func cmdLs() {
 	}
 }
 
+// cmdWhich explains which filter rt run would use for a command: the
+// segment that is matched, every filter whose patterns match it, and the
+// winner, after variants that don't need the output.
+func cmdWhich(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "rt: usage: rt which <command...>")
+		os.Exit(1)
+	}
+	filters, err := loadFiltersWithCache()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rt: error loading filters: %v\n", err)
+		os.Exit(1)
+	}
+
+	cmdStr := strings.Join(args, " ")
+	matchCmd := extractMatchCmd(cmdStr)
+	fmt.Printf("segment: %s\n", matchCmd)
+	candidates := matchCandidates(filters, matchCmd)
+	if len(candidates) == 0 {
+		fmt.Println("no filter matches; the output passes through unfiltered")
+		return
+	}
+
+	nameWidth, patternWidth := 0, 0
+	for _, c := range candidates {
+		nameWidth = max(nameWidth, len(c.Filter.Name))
+		patternWidth = max(patternWidth, len(c.Pattern))
+	}
+	for i, c := range candidates {
+		mark := " "
+		if i == 0 && c.Excluded == "" {
+			mark = "→"
+		}
+		line := fmt.Sprintf("  %s %-*s  %-*s  score %d", mark, nameWidth, c.Filter.Name, patternWidth, c.Pattern, c.Score)
+		if c.Filter.Priority != 0 {
+			line += fmt.Sprintf(", priority %d", c.Filter.Priority)
+		}
+		line += "  [" + c.Filter.Source + "]"
+		if c.Excluded != "" {
+			line += fmt.Sprintf("  excluded by %q", c.Excluded)
+		}
+		fmt.Println(line)
+	}
+
+	f := matchFilter(filters, cmdStr)
+	if f == nil {
+		fmt.Println("no filter applies; the output passes through unfiltered")
+		return
+	}
+	winner := f.Name
+	v := resolveVariant(filters, f, newVariantContext(cmdStr))
+	if v != f {
+		winner += " → variant " + v.Name
+	}
+	for _, variant := range v.Variants {
+		if len(variant.Detect.OutputContains) > 0 {
+			winner += " (a variant may still be picked from the output)"
+			break
+		}
+	}
+	fmt.Printf("winner: %s\n", winner)
+}
+
 func cmdShow(args []string) {
 	if len(args) == 0 {
 		fmt.Fprintln(os.Stderr, "rt: usage: rt show <filter-name>")
@@ -127,9 +457,36 @@ func cmdCheck(args []string) {
 		os.Exit(1)
 	}
 
-	_, err = parseFilter(data, "check", "file", args[0])
+	f, problems, err := decodeFilter(data)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "rt: invalid filter: %v\n", err)
+		fmt.Fprintf(os.Stderr, "rt: invalid filter: %s\n", describeDecodeError(args[0], err))
+		os.Exit(1)
+	}
+	failed := false
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "rt: %s\n", p.in(args[0]))
+		failed = true
+	}
+
+	// Variant children are resolved by name from the merged filter set
+	if len(f.Variants) > 0 {
+		filters, err := loadAllFilters()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rt: error loading filters: %v\n", err)
+			os.Exit(1)
+		}
+		for _, v := range f.Variants {
+			if v.Detect.isEmpty() {
+				fmt.Fprintf(os.Stderr, "rt: variant %q has no detect rules and will never match\n", v.Name)
+				failed = true
+			}
+		}
+		for _, name := range missingVariantTargets(filters, &f) {
+			fmt.Fprintf(os.Stderr, "rt: variant filter not found: %s\n", name)
+			failed = true
+		}
+	}
+	if failed {
 		os.Exit(1)
 	}
 
@@ -192,8 +549,16 @@ func cmdAdd(args []string) {
 	}
 
 	// Validate
-	if _, err := parseFilter(data, "check", "file", src); err != nil {
-		fmt.Fprintf(os.Stderr, "rt: invalid filter: %v\n", err)
+	_, problems, err := decodeFilter(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rt: invalid filter: %s\n", describeDecodeError(baseName, err))
+		os.Exit(1)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "rt: %s\n", p.in(baseName))
+		}
+		fmt.Fprintln(os.Stderr, "rt: invalid filter, not installed")
 		os.Exit(1)
 	}
 
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config holds global settings from ~/.config/rt/config.toml.
+// Every field is optional; a missing file means all defaults.
+type Config struct {
+	// StripAnsi strips ANSI escapes from passthrough output (no filter matched).
+	StripAnsi bool `toml:"strip_ansi"`
+	// MaxTokens caps the output of every run whose filter doesn't set its own
+	// max_tokens, including passthrough. 0 means no limit.
+	MaxTokens int `toml:"max_tokens"`
+	// LogTemplates compresses long passthrough output into log templates.
+	LogTemplates LogTemplates `toml:"log_templates"`
+}
+
+func configPath() string {
+	cfg, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(os.Getenv("HOME"), ".config", "rt", "config.toml")
+	}
+	return filepath.Join(cfg, "rt", "config.toml")
+}
+
+// loadConfig reads the global config. Errors other than a missing file are
+// reported on stderr and defaults are used — config must never block a run.
+func loadConfig() Config {
+	var c Config
+	data, err := os.ReadFile(configPath())
+	if err != nil {
+		return c
+	}
+	if err := toml.Unmarshal(data, &c); err != nil {
+		fmt.Fprintf(os.Stderr, "rt: warning: invalid config %s: %v\n", configPath(), err)
+		return Config{}
+	}
+	return c
+}
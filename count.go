@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compiledCount is a [[count]] rule with its regex compiled.
+type compiledCount struct {
+	name string
+	re   *regexp.Regexp
+	sum  bool
+}
+
+// counters accumulates [[count]] variables line by line. Every rule sees
+// every line; rules sharing a name add to the same variable.
+type counters struct {
+	rules  []compiledCount
+	values map[string]float64
+}
+
+func newCounters(rules []CountRule) *counters {
+	c := &counters{values: make(map[string]float64)}
+	for _, r := range rules {
+		if r.Name == "" {
+			continue
+		}
+		// Declared variables render as 0 even if nothing matched
+		c.values[r.Name] += 0
+		re, err := compileRegex(r.Pattern)
+		if err != nil {
+			continue
+		}
+		c.rules = append(c.rules, compiledCount{r.Name, re, r.Sum})
+	}
+	return c
+}
+
+// add counts line against every rule. A sum rule adds the number in its
+// first non-empty capture group instead of 1, so alternatives like
+// "added (\d+)|Packages: \+(\d+)" work; text that isn't a number adds 0.
+func (c *counters) add(line string) {
+	for _, r := range c.rules {
+		m := r.re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if !r.sum {
+			c.values[r.name]++
+			continue
+		}
+		for _, group := range m[1:] {
+			if group != "" {
+				n, _ := strconv.ParseFloat(strings.ReplaceAll(group, ",", ""), 64)
+				c.values[r.name] += n
+				break
+			}
+		}
+	}
+}
+
+// vars adds the counter values to vars.
+func (c *counters) vars(vars map[string]string) {
+	for name, v := range c.values {
+		vars[name] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+}
+
+// summaryVars returns the values on_success / on_failure templates see
+// besides {output}: the per-stream text, the [[count]] variables and the
+// built-ins. Counters don't shadow built-ins.
+func summaryVars(c *counters, streams streamText, exitCode, linesTotal int, duration time.Duration) map[string]string {
+	vars := make(map[string]string)
+	c.vars(vars)
+	vars["stdout"] = strings.Join(streams.Stdout, "\n")
+	vars["stderr"] = strings.Join(streams.Stderr, "\n")
+	vars["exit_code"] = strconv.Itoa(exitCode)
+	vars["lines_total"] = strconv.Itoa(linesTotal)
+	vars["duration"] = formatDuration(duration)
+	return vars
+}
+
+// formatDuration renders a run time for templates: "850ms", "12.3s", "2m5s".
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	if d < time.Minute {
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DiagnosticsBlock is the diagnostics step: it reads compiler and linter
+// diagnostics into records and prints them as one compact list. It decodes
+// from `diagnostics = true` or from a [diagnostics] table.
+type DiagnosticsBlock struct {
+	Enabled bool
+	PerFile int // diagnostics printed per file (default 10)
+	Max     int // diagnostics printed in total (default 50)
+
+	unknown []string // keys rt doesn't know, reported by rt check
+}
+
+const (
+	defaultDiagnosticsPerFile = 10
+	defaultDiagnosticsMax     = 50
+)
+
+func (d *DiagnosticsBlock) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case bool:
+		d.Enabled = v
+	case map[string]interface{}:
+		d.Enabled = true
+		for key, value := range v {
+			if key != "per_file" && key != "max" {
+				d.unknown = append(d.unknown, key)
+				continue
+			}
+			n, ok := value.(int64)
+			if !ok {
+				return fmt.Errorf("diagnostics.%s: expected integer, got %T", key, value)
+			}
+			if key == "per_file" {
+				d.PerFile = int(n)
+			} else {
+				d.Max = int(n)
+			}
+		}
+		sort.Strings(d.unknown)
+	default:
+		return fmt.Errorf("expected true or a table, got %T", data)
+	}
+	return nil
+}
+
+// diagnostic is one compiler or linter message.
+type diagnostic struct {
+	path      string
+	line, col int // col is 0 when the tool doesn't report one
+	severity  string
+	message   string
+	code      string // rule or error code, e.g. E0425, TS2322, no-undef
+}
+
+func (d diagnostic) String() string {
+	loc := d.path + ":" + strconv.Itoa(d.line)
+	if d.col > 0 {
+		loc += ":" + strconv.Itoa(d.col)
+	}
+	msg := d.message
+	if d.code != "" && !strings.Contains(msg, "["+d.code+"]") {
+		msg += " [" + d.code + "]"
+	}
+	return loc + ": " + d.severity + ": " + msg
+}
+
+var (
+	// tsc: "src/a.ts(12,5): error TS2322: ..." and, with --pretty,
+	// "src/a.ts:12:5 - error TS2322: ..."
+	tscRe       = regexp.MustCompile(`^([^\s(]+)\((\d+),(\d+)\): (error|warning|message) (TS\d+): (.*)$`)
+	tscPrettyRe = regexp.MustCompile(`^(\S+):(\d+):(\d+) - (error|warning|message) (TS\d+): (.*)$`)
+	// gcc, clang, mypy, rustc --error-format=short:
+	// "src/a.c:12:5: error: ...", "app.py:3: error: ...  [assignment]"
+	ccDiagRe = regexp.MustCompile(`^(\S+?):(\d+):(?:(\d+):)? (fatal error|error|warning|note|remark|help)(?:\[(\S+?)\])?: (.*)$`)
+	// ruff --output-format=concise: "app.py:1:8: F401 [*] `os` imported but unused"
+	ruffConciseRe = regexp.MustCompile(`^(\S+?):(\d+):(\d+): ([A-Z]+\d+) (?:\[\*\] )?(.*)$`)
+	// go build / go vet: "./main.go:12:5: undefined: foo"
+	goDiagRe = regexp.MustCompile(`^(?:vet: )?(\S+\.go):(\d+)(?::(\d+))?: (.*)$`)
+
+	// Headers whose location comes on the next line, " --> path:line:col":
+	// rustc ("error[E0425]: ...") and ruff's full format ("F401 [*] ...").
+	rustHeaderRe = regexp.MustCompile(`^(error|warning)(?:\[(\w+)\])?: (.+)$`)
+	ruffHeaderRe = regexp.MustCompile(`^([A-Z]{1,4}\d{3,4}) (?:\[\*\] )?(.+)$`)
+	arrowRe      = regexp.MustCompile(`^\s*--> (\S+?):(\d+):(\d+)$`)
+
+	// eslint's stylish format: a file name line, then one row per problem
+	// ("  12:5  error  'x' is not defined  no-undef").
+	eslintFileRe = regexp.MustCompile(`^(?:[A-Za-z]:)?[\w@.~/\\-]*[/\\][\w@.~/\\-]*\.\w+$|^[\w@.-]+\.\w+$`)
+	eslintRowRe  = regexp.MustCompile(`^\s+(\d+):(\d+)\s+(error|warning)\s+(.+?)(?:\s{2,}([\w@/-]+))?$`)
+
+	// mypy appends the error code: "...  [assignment]"
+	trailingCodeRe = regexp.MustCompile(`\s+\[([\w-]+)\]$`)
+
+	// diagnosticBodyRe matches what follows a diagnostic: source snippets,
+	// carets, help and note lines.
+	diagnosticBodyRe = regexp.MustCompile(`^$|^\t|^\s*(\d+\s*|\+\+\+\s*)?\|(\s|\+|$)|^\s*(= |::: )|^\s*\.\.\.$|^\d+ |^\s+~+$|^(help|note)(\[\w+\])?: `)
+)
+
+// diagnosticNoise are the tools' own summaries and context lines, which the
+// step's summary replaces.
+var diagnosticNoise = compileNoise(
+	`^error: aborting due to`,
+	`^(warning|error): .* generated \d+ warnings?`,
+	`^For more information about (this|an) error`,
+	`^Some errors have detailed explanations`,
+	`^Found \d+ (errors?|warnings?)`,
+	`^\d+ (errors?|warnings?)( and \d+ (errors?|warnings?))? generated\.$`,
+	`^[✖×] \d+ problems?`,
+	`^\s*\d+ errors? and \d+ warnings? potentially fixable`,
+	`^\[\*\] \d+ fixable`,
+	`^No fixes available`,
+	`^Errors\s+Files$`,
+	`^\s+\d+\s+\S+:\d+$`,
+	`^In file included from `,
+	`^\s+from \S+:\d+[:,]$`,
+	`^\S+: (In|At) .*:$`,
+	`^# \S+$`,
+)
+
+func compileNoise(patterns ...string) []*regexp.Regexp {
+	out := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		out[i] = regexp.MustCompile(p)
+	}
+	return out
+}
+
+// diagnosticsRunner collects diagnostics. Lines that aren't part of a
+// diagnostic pass through right away; the diagnostics themselves are
+// printed by flush, once the output has ended, since they are deduped and
+// grouped by file.
+type diagnosticsRunner struct {
+	perFile, max int
+
+	records []diagnostic
+	seen    map[diagnostic]bool
+
+	held       string // a header waiting for its location line
+	holding    bool
+	eslintFile string // the file eslint rows belong to
+	inBody     bool   // dropping a diagnostic's snippet and help lines
+	blanks     int    // blank lines held until the next line that passes
+	passed     bool   // whether any line has passed through
+}
+
+func newDiagnosticsRunner(block DiagnosticsBlock) *diagnosticsRunner {
+	r := &diagnosticsRunner{
+		perFile: defaultDiagnosticsPerFile,
+		max:     defaultDiagnosticsMax,
+		seen:    make(map[diagnostic]bool),
+	}
+	if block.PerFile > 0 {
+		r.perFile = block.PerFile
+	}
+	if block.Max > 0 {
+		r.max = block.Max
+	}
+	return r
+}
+
+// push feeds the next line and returns the lines to pass through now.
+func (r *diagnosticsRunner) push(line string) []string {
+	if r.holding {
+		header := r.held
+		r.holding = false
+		if m := arrowRe.FindStringSubmatch(line); m != nil {
+			r.add(headerDiagnostic(header, m))
+			r.inBody = true
+			return nil
+		}
+		if m := eslintRowRe.FindStringSubmatch(line); m != nil && eslintFileRe.MatchString(header) {
+			r.eslintFile = header
+			r.add(eslintDiagnostic(header, m))
+			return nil
+		}
+		out := r.pass(header)
+		return append(out, r.push(line)...)
+	}
+
+	if r.eslintFile != "" {
+		if m := eslintRowRe.FindStringSubmatch(line); m != nil {
+			r.add(eslintDiagnostic(r.eslintFile, m))
+			return nil
+		}
+		r.eslintFile = ""
+	}
+	if r.inBody {
+		if diagnosticBodyRe.MatchString(line) {
+			return nil
+		}
+		r.inBody = false
+	}
+
+	if d, ok := parseDiagnostic(line); ok {
+		r.add(d)
+		r.inBody = true
+		return nil
+	}
+	if rustHeaderRe.MatchString(line) || ruffHeaderRe.MatchString(line) || eslintFileRe.MatchString(line) {
+		r.held, r.holding = line, true
+		return nil
+	}
+	return r.pass(line)
+}
+
+// pass returns line unless it is tool noise. Blank lines are held so the
+// ones that separated diagnostics don't pile up: they only pass between
+// two lines that do.
+func (r *diagnosticsRunner) pass(line string) []string {
+	if strings.TrimSpace(line) == "" {
+		r.blanks++
+		return nil
+	}
+	if matchesAny(diagnosticNoise, line) {
+		return nil
+	}
+	var out []string
+	if r.passed {
+		for ; r.blanks > 0; r.blanks-- {
+			out = append(out, "")
+		}
+	}
+	r.blanks = 0
+	r.passed = true
+	return append(out, line)
+}
+
+func (r *diagnosticsRunner) add(d diagnostic) {
+	r.blanks = 0
+	if d.severity == "note" || d.severity == "help" || r.seen[d] {
+		return
+	}
+	r.seen[d] = true
+	r.records = append(r.records, d)
+}
+
+// parseDiagnostic reads a diagnostic that fits on one line.
+func parseDiagnostic(line string) (diagnostic, bool) {
+	if m := tscRe.FindStringSubmatch(line); m != nil {
+		return newDiagnostic(m[1], m[2], m[3], m[4], m[6], m[5]), true
+	}
+	if m := tscPrettyRe.FindStringSubmatch(line); m != nil {
+		return newDiagnostic(m[1], m[2], m[3], m[4], m[6], m[5]), true
+	}
+	if m := ccDiagRe.FindStringSubmatch(line); m != nil {
+		msg, code := m[6], m[5]
+		if c := trailingCodeRe.FindStringSubmatch(msg); c != nil && code == "" {
+			msg, code = strings.TrimSuffix(msg, c[0]), c[1]
+		}
+		return newDiagnostic(m[1], m[2], m[3], m[4], msg, code), true
+	}
+	if m := ruffConciseRe.FindStringSubmatch(line); m != nil {
+		return newDiagnostic(m[1], m[2], m[3], "error", m[5], m[4]), true
+	}
+	if m := goDiagRe.FindStringSubmatch(line); m != nil {
+		return newDiagnostic(m[1], m[2], m[3], "error", m[4], ""), true
+	}
+	return diagnostic{}, false
+}
+
+// headerDiagnostic combines a rustc or ruff header with its location line.
+func headerDiagnostic(header string, loc []string) diagnostic {
+	if m := rustHeaderRe.FindStringSubmatch(header); m != nil {
+		return newDiagnostic(loc[1], loc[2], loc[3], m[1], m[3], m[2])
+	}
+	m := ruffHeaderRe.FindStringSubmatch(header)
+	return newDiagnostic(loc[1], loc[2], loc[3], "error", m[2], m[1])
+}
+
+func eslintDiagnostic(path string, m []string) diagnostic {
+	return newDiagnostic(path, m[1], m[2], m[3], m[4], m[5])
+}
+
+func newDiagnostic(path, line, col, severity, message, code string) diagnostic {
+	d := diagnostic{
+		path:     relpathFunc(strings.TrimPrefix(path, "./"), ""),
+		severity: severity,
+		message:  strings.TrimSpace(message),
+		code:     code,
+	}
+	d.line, _ = strconv.Atoi(line)
+	d.col, _ = strconv.Atoi(col)
+	switch severity {
+	case "fatal error":
+		d.severity = "error"
+	case "remark", "message":
+		d.severity = "info"
+	}
+	return d
+}
+
+// severityRank orders a file's diagnostics: errors first.
+func severityRank(s string) int {
+	switch s {
+	case "error":
+		return 0
+	case "warning":
+		return 1
+	}
+	return 2
+}
+
+// flush returns a held line and the diagnostics, grouped by file in order of
+// first appearance, errors first within a file, then a summary line.
+func (r *diagnosticsRunner) flush() []string {
+	var out []string
+	if r.holding {
+		r.holding = false
+		out = r.pass(r.held)
+	}
+	if len(r.records) == 0 {
+		return out
+	}
+
+	var files []string
+	byFile := make(map[string][]diagnostic)
+	counts := make(map[string]int)
+	for _, d := range r.records {
+		if _, ok := byFile[d.path]; !ok {
+			files = append(files, d.path)
+		}
+		byFile[d.path] = append(byFile[d.path], d)
+		counts[d.severity]++
+	}
+
+	shown, hidden, hiddenFiles := 0, 0, 0
+	for _, path := range files {
+		ds := byFile[path]
+		if shown >= r.max {
+			hidden += len(ds)
+			hiddenFiles++
+			continue
+		}
+		sort.SliceStable(ds, func(i, j int) bool {
+			a, b := ds[i], ds[j]
+			if severityRank(a.severity) != severityRank(b.severity) {
+				return severityRank(a.severity) < severityRank(b.severity)
+			}
+			if a.line != b.line {
+				return a.line < b.line
+			}
+			return a.col < b.col
+		})
+		take := min(len(ds), r.perFile, r.max-shown)
+		for _, d := range ds[:take] {
+			out = append(out, d.String())
+		}
+		shown += take
+		if rest := len(ds) - take; rest > 0 {
+			out = append(out, fmt.Sprintf("… %d more in %s", rest, path))
+		}
+	}
+	if hidden > 0 {
+		out = append(out, fmt.Sprintf("… %d more in %s", hidden, plural(hiddenFiles, "file")))
+	}
+
+	r.records = nil
+	r.seen = make(map[diagnostic]bool)
+	return append(out, diagnosticsSummary(counts, len(files)))
+}
+
+// diagnosticsSummary renders e.g. "3 errors, 1 warning in 2 files".
+func diagnosticsSummary(counts map[string]int, files int) string {
+	var parts []string
+	for _, sev := range []string{"error", "warning", "info"} {
+		if n := counts[sev]; n > 0 {
+			if sev == "info" {
+				parts = append(parts, fmt.Sprintf("%d info", n))
+			} else {
+				parts = append(parts, plural(n, sev))
+			}
+		}
+	}
+	return strings.Join(parts, ", ") + " in " + plural(files, "file")
+}
+
+// applyDiagnostics runs the diagnostics step over the whole output.
+func applyDiagnostics(block DiagnosticsBlock, lines []string) []string {
+	r := newDiagnosticsRunner(block)
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		out = append(out, r.push(line)...)
+	}
+	return append(out, r.flush()...)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DiffBlock is the [diff] section: it reads unified diffs (git diff, git
+// show, gh pr diff) file by file and hunk by hunk, so each file can be
+// shown, budgeted or summarized on its own.
+type DiffBlock struct {
+	FileLines int      `toml:"file_lines"` // diff lines shown per file (default 60)
+	Generated []string `toml:"generated"`  // extra path globs summarized as generated
+}
+
+const (
+	defaultDiffFileLines = 60
+	// minifiedLineLen is the line length from which a file counts as minified.
+	minifiedLineLen = 500
+	// generatedMarkerLines is how many lines of a file are searched for a
+	// "generated" marker.
+	generatedMarkerLines = 20
+)
+
+// lockfileNames are the dependency lockfiles summarized in one line.
+var lockfileNames = map[string]bool{
+	"package-lock.json": true, "npm-shrinkwrap.json": true, "yarn.lock": true,
+	"pnpm-lock.yaml": true, "bun.lockb": true, "Cargo.lock": true, "go.sum": true,
+	"poetry.lock": true, "Pipfile.lock": true, "uv.lock": true, "composer.lock": true,
+	"Gemfile.lock": true, "mix.lock": true, "pubspec.lock": true, "flake.lock": true,
+	"packages.lock.json": true, "Package.resolved": true,
+}
+
+var (
+	diffGitRe    = regexp.MustCompile(`^diff --git a/(.+) b/(.+)$`)
+	diffHunkRe   = regexp.MustCompile(`^@@ -\d+(?:,(\d+))? \+(\d+)(?:,(\d+))? @@ ?(.*)$`)
+	diffBinaryRe = regexp.MustCompile(`^Binary files .* differ$|^GIT binary patch$`)
+	// diffHeaderRe matches the extended header lines between "diff --git"
+	// and the first hunk.
+	diffHeaderRe = regexp.MustCompile(`^(index |old mode |new mode |similarity index |dissimilarity index |rename to |copy from |copy to |--- |\+\+\+ )`)
+
+	generatedPathRe = regexp.MustCompile(`(^|/)__snapshots__/|\.snap$|\.pb\.go$|_pb2(_grpc)?\.pyi?$|\.g\.dart$|\.generated\.\w+$|\.designer\.cs$`)
+	vendoredPathRe  = regexp.MustCompile(`(^|/)(vendor|node_modules|third_party)/`)
+	minifiedPathRe  = regexp.MustCompile(`\.min\.(js|css)$|\.(js|css)\.map$`)
+	generatedMarker = regexp.MustCompile(`Code generated .* DO NOT EDIT|@generated|<auto-generated|(?i)this file (is|was) (automatically|auto-)generated`)
+)
+
+// diffFile is one file of a diff being read.
+type diffFile struct {
+	path, oldPath string
+	status        string // "new", "deleted", "renamed" or ""
+	kind          string // why it is summarized: lockfile, generated, vendored, minified, binary
+	added         int
+	removed       int
+
+	body       []string // rendered hunks, up to the budget
+	omitted    int      // rendered lines past the budget
+	whitespace int      // hunks collapsed as whitespace-only
+	seen       int      // content lines read, for the generated marker
+
+	// The hunk being read and the lines it still expects
+	hunk     []string
+	hunkHead string
+	oldLeft  int
+	newLeft  int
+}
+
+// diffRunner compresses a unified diff. Each file is printed once it ends:
+// lockfiles, generated, vendored, minified and binary files as one line
+// "path: +N −M (kind)", other files as their hunks, with whitespace-only
+// hunks collapsed and at most FileLines lines. Lines outside the diff (a
+// commit header) pass through. flush ends with a --stat style overview of
+// all files.
+type diffRunner struct {
+	budget    int
+	generated []string
+
+	file    *diffFile
+	stats   []string // overview lines
+	hidden  bool     // a file wasn't shown in full
+	files   int
+	added   int
+	removed int
+}
+
+func newDiffRunner(block *DiffBlock) *diffRunner {
+	r := &diffRunner{budget: defaultDiffFileLines}
+	if block == nil {
+		return r
+	}
+	if block.FileLines > 0 {
+		r.budget = block.FileLines
+	}
+	r.generated = block.Generated
+	return r
+}
+
+// push feeds the next line and returns the lines to emit now.
+func (r *diffRunner) push(line string) []string {
+	if m := diffGitRe.FindStringSubmatch(line); m != nil {
+		out := r.finish()
+		r.file = &diffFile{path: m[2], oldPath: m[1]}
+		r.file.kind = r.pathKind(m[2])
+		return out
+	}
+	f := r.file
+	if f == nil {
+		return []string{line}
+	}
+	if f.oldLeft > 0 || f.newLeft > 0 {
+		r.hunkLine(line)
+		return nil
+	}
+	if m := diffHunkRe.FindStringSubmatch(line); m != nil {
+		r.endHunk()
+		f.oldLeft = hunkCount(m[1])
+		f.newLeft = hunkCount(m[3])
+		f.hunkHead = "@@ L" + m[2]
+		if m[4] != "" {
+			f.hunkHead += " " + m[4]
+		}
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(line, "new file mode "):
+		f.status = "new"
+	case strings.HasPrefix(line, "deleted file mode "):
+		f.status = "deleted"
+	case strings.HasPrefix(line, "rename from "):
+		f.status = "renamed"
+	case diffBinaryRe.MatchString(line):
+		f.kind = "binary"
+	case strings.HasPrefix(line, `\ `), diffHeaderRe.MatchString(line):
+	case f.kind == "binary" && line != "":
+		// Binary patch data
+	default:
+		// Anything else ends the diff, e.g. the next commit of git log -p
+		return append(r.finish(), line)
+	}
+	return nil
+}
+
+// hunkCount reads a hunk header line count, which is 1 when omitted.
+func hunkCount(s string) int {
+	if s == "" {
+		return 1
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func (r *diffRunner) hunkLine(line string) {
+	f := r.file
+	switch {
+	case strings.HasPrefix(line, "+"):
+		f.added++
+		f.newLeft--
+	case strings.HasPrefix(line, "-"):
+		f.removed++
+		f.oldLeft--
+	case strings.HasPrefix(line, `\`):
+		// "\ No newline at end of file"
+	default:
+		// Context; some tools strip the space of empty context lines
+		f.oldLeft--
+		f.newLeft--
+	}
+	if f.seen < generatedMarkerLines && !strings.HasPrefix(line, "-") && generatedMarker.MatchString(line) && f.kind == "" {
+		f.kind = "generated"
+	}
+	f.seen++
+	if len(line) > minifiedLineLen && f.kind == "" {
+		f.kind = "minified"
+	}
+	if f.kind == "" {
+		f.hunk = append(f.hunk, line)
+	}
+	if f.oldLeft <= 0 && f.newLeft <= 0 {
+		f.oldLeft, f.newLeft = 0, 0
+		r.endHunk()
+	}
+}
+
+// endHunk adds the hunk read so far to the file's body, collapsed to its
+// header when it only changes whitespace.
+func (r *diffRunner) endHunk() {
+	f := r.file
+	if f.hunkHead == "" {
+		return
+	}
+	if f.kind == "" {
+		if n := len(f.hunk); n > 0 && whitespaceOnly(f.hunk) {
+			f.whitespace++
+			r.addBody(fmt.Sprintf("%s (whitespace only, %d lines)", f.hunkHead, n))
+		} else {
+			r.addBody(f.hunkHead)
+			for _, line := range f.hunk {
+				r.addBody(line)
+			}
+		}
+	}
+	f.hunk, f.hunkHead = nil, ""
+}
+
+func (r *diffRunner) addBody(line string) {
+	f := r.file
+	if len(f.body) < r.budget {
+		f.body = append(f.body, line)
+	} else {
+		f.omitted++
+	}
+}
+
+// whitespaceOnly reports whether a hunk's removed and added lines differ
+// only in whitespace.
+func whitespaceOnly(hunk []string) bool {
+	var removed, added strings.Builder
+	changed := false
+	for _, line := range hunk {
+		switch {
+		case strings.HasPrefix(line, "-"):
+			removed.WriteString(stripSpace(line[1:]))
+			changed = true
+		case strings.HasPrefix(line, "+"):
+			added.WriteString(stripSpace(line[1:]))
+			changed = true
+		}
+	}
+	return changed && removed.String() == added.String()
+}
+
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// pathKind tells from its path whether a file is summarized.
+func (r *diffRunner) pathKind(p string) string {
+	switch {
+	case lockfileNames[path.Base(p)]:
+		return "lockfile"
+	case vendoredPathRe.MatchString(p):
+		return "vendored"
+	case minifiedPathRe.MatchString(p):
+		return "minified"
+	case generatedPathRe.MatchString(p), matchesGlob(r.generated, p):
+		return "generated"
+	}
+	return ""
+}
+
+// matchesGlob reports whether p matches any glob, as a whole path or by its
+// base name; a pattern ending in "/" matches everything under it.
+func matchesGlob(globs []string, p string) bool {
+	for _, g := range globs {
+		if strings.HasSuffix(g, "/") {
+			if strings.HasPrefix(p, g) || strings.Contains(p, "/"+g) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(g, p); ok {
+			return true
+		}
+		if ok, _ := path.Match(g, path.Base(p)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// finish renders the current file, if any.
+func (r *diffRunner) finish() []string {
+	f := r.file
+	if f == nil {
+		return nil
+	}
+	r.endHunk()
+	r.file = nil
+	r.files++
+	r.added += f.added
+	r.removed += f.removed
+
+	counts := fmt.Sprintf("+%d −%d", f.added, f.removed)
+	kind := f.kind
+	if kind == "" && f.status == "deleted" {
+		kind = "deleted"
+	}
+	if kind != "" {
+		summary := counts + " (" + kind + ")"
+		if kind == "binary" {
+			summary = "(binary)"
+		}
+		r.stat(f.path, summary, true)
+		return []string{f.path + ": " + summary}
+	}
+
+	header := "=== " + f.path
+	switch f.status {
+	case "new":
+		header += " (new)"
+	case "renamed":
+		header = "=== " + f.oldPath + " → " + f.path
+	}
+	out := append([]string{header}, f.body...)
+	var notes []string
+	if f.omitted > 0 {
+		out = append(out, fmt.Sprintf("… %s omitted …", plural(f.omitted, "line")))
+		notes = append(notes, fmt.Sprintf("%s omitted", plural(f.omitted, "line")))
+	}
+	if f.whitespace > 0 {
+		notes = append(notes, plural(f.whitespace, "whitespace-only hunk"))
+	}
+	if len(notes) > 0 {
+		counts += " (" + strings.Join(notes, ", ") + ")"
+	}
+	r.stat(f.path, counts, len(notes) > 0)
+	return out
+}
+
+// stat adds a file to the overview; hidden tells it wasn't shown in full.
+func (r *diffRunner) stat(path, summary string, hidden bool) {
+	r.stats = append(r.stats, path+"\x00"+summary)
+	r.hidden = r.hidden || hidden
+}
+
+// flush renders the last file and, when the diff has more than one file or
+// one wasn't shown in full, an overview of all files aligned like git diff
+// --stat.
+func (r *diffRunner) flush() []string {
+	out := r.finish()
+	if r.files < 2 && !r.hidden {
+		r.stats, r.files, r.added, r.removed = nil, 0, 0, 0
+		return out
+	}
+	width := 0
+	for _, s := range r.stats {
+		p, _, _ := strings.Cut(s, "\x00")
+		width = max(width, len([]rune(p)))
+	}
+	for _, s := range r.stats {
+		p, summary, _ := strings.Cut(s, "\x00")
+		out = append(out, fmt.Sprintf(" %s%s | %s", p, strings.Repeat(" ", width-len([]rune(p))), summary))
+	}
+	out = append(out, fmt.Sprintf(" %s changed, +%d −%d", plural(r.files, "file"), r.added, r.removed))
+	r.stats, r.hidden = nil, false
+	r.files, r.added, r.removed = 0, 0, 0
+	return out
+}
+
+// applyDiff runs a [diff] block over the whole output.
+func applyDiff(block *DiffBlock, lines []string) []string {
+	r := newDiffRunner(block)
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		out = append(out, r.push(line)...)
+	}
+	return append(out, r.flush()...)
+}
@@ -3,135 +3,438 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 )
 
 // applyFilter processes raw output through a filter and returns the filtered result.
+// The output's stream of origin is unknown, so it all counts as stdout.
 func applyFilter(f *Filter, raw string, exitCode int) string {
+	return applyFilterResult(f, textResult(raw, exitCode))
+}
+
+// applyFilterResult processes a command's captured output through a filter
+// and returns the filtered result.
+func applyFilterResult(f *Filter, res runResult) string {
+	return applyFilterTraced(f, res, nil)
+}
+
+// applyFilterTraced is applyFilterResult recording every stage in tr, which
+// may be nil.
+func applyFilterTraced(f *Filter, res runResult, tr *pipelineTrace) string {
+	raw := res.Output
+	tr.start(raw)
+
+	// Strip ANSI escapes before anything looks at the text
+	if f.StripAnsi {
+		done := tr.beginQuiet("strip_ansi", splitLines(raw))
+		raw = stripAnsi(raw)
+		done(splitLines(raw))
+	}
+
 	// Check match_output rules first (short-circuit)
-	for _, rule := range f.MatchOutput {
-		if rule.Contains != "" && strings.Contains(raw, rule.Contains) {
-			return rule.Output
-		}
-		if rule.Matches != "" {
-			if re, err := compileRegex(rule.Matches); err == nil && re.MatchString(raw) {
-				return rule.Output
-			}
-		}
+	if i, out, ok := matchOutputRule(f.MatchOutput, raw); ok {
+		tr.shortCircuit(fmt.Sprintf("match_output[%d]", i), splitLines(raw), splitLines(out))
+		return out
 	}
 
-	lines := strings.Split(raw, "\n")
+	lines := splitLines(raw)
 
-	// Remove trailing empty line from split
-	if len(lines) > 0 && lines[len(lines)-1] == "" {
-		lines = lines[:len(lines)-1]
+	linesTotal := len(lines)
+
+	// Pick streams and apply the per-stream skip/keep rules
+	done := tr.begin("streams", lines, nil)
+	lines, streams := selectStreams(f, lines, res.stderrLines)
+	done(lines)
+
+	// Count and read test results before the line steps drop what they need
+	counts := newCounters(f.Count)
+	tests := newTestReporter(f)
+	for _, line := range lines {
+		counts.add(line)
+		tests.push(line)
+	}
+
+	// [json] replaces the line steps when the output parses as JSON
+	done = tr.begin("json", lines, nil)
+	if rendered, ok := applyJSONBlock(f.JSON, lines); ok {
+		lines = rendered
+		done(lines)
+	} else {
+		lines = applyLineSteps(f, lines, tr)
+	}
+
+	// Apply on_success / on_failure blocks
+	result := strings.Join(lines, "\n")
+	block, name := f.OnSuccess, "on_success"
+	if res.ExitCode != 0 {
+		block, name = f.OnFailure, "on_failure"
+	}
+	if block != nil {
+		done := tr.begin(name, lines, blockRule(name, block))
+		vars := summaryVars(counts, streams, res.ExitCode, linesTotal, res.Duration)
+		lines, result = tests.apply(block, lines, result, vars, res)
+		result = applyOutputBlock(block, lines, result, vars)
+		done(splitLines(result))
+	}
+
+	// Enforce the token budget last, on exactly what the agent will see
+	if f.MaxTokens > 0 {
+		done := tr.begin("max_tokens", splitLines(result), nil)
+		result = applyTokenBudget(result, f.MaxTokens, importantPatterns(f))
+		done(splitLines(result))
+	}
+	return result
+}
+
+// applyLineSteps runs the steps from stacktrace to dedupe, recording them in
+// tr, which may be nil.
+func applyLineSteps(f *Filter, lines []string, tr *pipelineTrace) []string {
+	// Shorten stack traces to their project frames
+	if f.StackTrace != nil {
+		done := tr.begin("stacktrace", lines, nil)
+		lines = applyStackTrace(f.StackTrace, lines)
+		done(lines)
+	}
+
+	// Reduce compiler and linter diagnostics to one compact list
+	if f.Diagnostics.Enabled {
+		done := tr.begin("diagnostics", lines, nil)
+		lines = applyDiagnostics(f.Diagnostics, lines)
+		done(lines)
+	}
+
+	// Compress unified diffs file by file
+	if f.Diff != nil {
+		done := tr.begin("diff", lines, nil)
+		lines = applyDiff(f.Diff, lines)
+		done(lines)
 	}
 
 	// Apply skip rules
 	if len(f.Skip) > 0 {
+		done := tr.begin("skip", lines, patternRule("skip", f.Skip))
 		lines = applySkip(lines, f.Skip)
+		done(lines)
 	}
 
 	// Apply keep rules (allowlist — only retain matching lines)
 	if len(f.Keep) > 0 {
-		lines = applyKeep(lines, f.Keep)
+		done := tr.begin("keep", lines, nil)
+		lines = applyKeep(lines, f.Keep, f.KeepContext)
+		done(lines)
+	}
+
+	// Apply per-section rules
+	if len(f.Sections) > 0 {
+		done := tr.begin("section", lines, nil)
+		lines = applySections(lines, f.Sections)
+		done(lines)
+	}
+
+	// Re-render whitespace-aligned tables by column
+	if f.Table != nil {
+		done := tr.begin("table", lines, nil)
+		lines = applyTable(f.Table, lines)
+		done(lines)
 	}
 
 	// Apply replace rules
 	if len(f.Replace) > 0 {
+		done := tr.begin("replace", lines, replaceRule("replace", f.Replace))
 		lines = applyReplace(lines, f.Replace)
+		done(lines)
 	}
 
-	// Apply on_success / on_failure blocks
-	result := strings.Join(lines, "\n")
-	if exitCode == 0 && f.OnSuccess != nil {
-		result = applyOutputBlock(f.OnSuccess, lines, result)
-	} else if exitCode != 0 && f.OnFailure != nil {
-		result = applyOutputBlock(f.OnFailure, lines, result)
+	// Group near-identical lines, then exact duplicates
+	if len(f.Collapse) > 0 {
+		done := tr.begin("collapse", lines, replaceRule("collapse", f.Collapse))
+		lines = applyCollapse(lines, f.Collapse)
+		done(lines)
 	}
+	if f.Dedupe {
+		done := tr.begin("dedupe", lines, nil)
+		lines = applyDedupe(lines)
+		done(lines)
+	}
+	return lines
+}
 
-	return result
+func applyJSONBlock(block *JSONBlock, lines []string) ([]string, bool) {
+	if block == nil {
+		return nil, false
+	}
+	return applyJSON(block, strings.Join(lines, "\n"))
 }
 
-func applySkip(lines []string, patterns []string) []string {
-	regexes := make([]*regexp.Regexp, 0, len(patterns))
-	for _, p := range patterns {
-		if re, err := compileRegex(p); err == nil {
-			regexes = append(regexes, re)
+// splitLines splits output into lines, dropping the empty string after a
+// trailing newline.
+func splitLines(raw string) []string {
+	lines := strings.Split(raw, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// plural renders a count with its noun, "1 line" or "3 lines". The noun may
+// carry words before it: plural(n, "library frame").
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// splitsStreams reports whether the filter looks at stdout and stderr
+// separately, which makes the runner capture them on separate pipes.
+func (f *Filter) splitsStreams() bool {
+	if (f.Streams != "" && f.Streams != "both") ||
+		len(f.SkipStdout) > 0 || len(f.SkipStderr) > 0 ||
+		len(f.KeepStdout) > 0 || len(f.KeepStderr) > 0 {
+		return true
+	}
+	for _, b := range []*OutputBlock{f.OnSuccess, f.OnFailure} {
+		if b != nil {
+			if t := compileTemplate(b.Output); t.uses("stdout") || t.uses("stderr") {
+				return true
+			}
 		}
 	}
+	return false
+}
+
+// streamText is the per-stream view exposed to output templates as
+// {stdout} and {stderr}.
+type streamText struct {
+	Stdout []string
+	Stderr []string
+}
+
+// streamRules holds a filter's compiled per-stream rules.
+type streamRules struct {
+	skip, keep [2][]*regexp.Regexp // index 0 = stdout, 1 = stderr
+	want       [2]bool
+}
+
+func compileStreamRules(f *Filter) streamRules {
+	var r streamRules
+	r.skip[0] = compilePatterns(f.SkipStdout)
+	r.skip[1] = compilePatterns(f.SkipStderr)
+	r.keep[0] = compilePatterns(f.KeepStdout)
+	r.keep[1] = compilePatterns(f.KeepStderr)
+	r.want[0] = f.Streams != "stderr"
+	r.want[1] = f.Streams != "stdout"
+	return r
+}
 
+// admit reports whether a line from the given stream survives the
+// per-stream rules, and whether it should continue down the pipeline.
+func (r *streamRules) admit(line string, stderr bool) (kept, selected bool) {
+	idx := 0
+	if stderr {
+		idx = 1
+	}
+	if matchesAny(r.skip[idx], line) {
+		return false, false
+	}
+	if len(r.keep[idx]) > 0 && !matchesAny(r.keep[idx], line) {
+		return false, false
+	}
+	return true, r.want[idx]
+}
+
+// selectStreams applies streams / skip_stdout / skip_stderr / keep_stdout /
+// keep_stderr. stderrLines marks lines that came from stderr (nil: none).
+// It returns the lines that continue down the pipeline and the per-stream
+// text for templates.
+func selectStreams(f *Filter, lines []string, stderrLines []bool) ([]string, streamText) {
+	rules := compileStreamRules(f)
+
+	var st streamText
 	out := make([]string, 0, len(lines))
-	for _, line := range lines {
-		skip := false
-		for _, re := range regexes {
-			if re.MatchString(line) {
-				skip = true
-				break
-			}
+	for i, line := range lines {
+		stderr := i < len(stderrLines) && stderrLines[i]
+		kept, selected := rules.admit(line, stderr)
+		if !kept {
+			continue
+		}
+		if stderr {
+			st.Stderr = append(st.Stderr, line)
+		} else {
+			st.Stdout = append(st.Stdout, line)
 		}
-		if !skip {
+		if selected {
 			out = append(out, line)
 		}
 	}
-	return out
+	return out, st
 }
 
-func applyKeep(lines []string, patterns []string) []string {
-	regexes := make([]*regexp.Regexp, 0, len(patterns))
-	for _, p := range patterns {
-		if re, err := compileRegex(p); err == nil {
-			regexes = append(regexes, re)
+func applySkip(lines []string, patterns []string) []string {
+	regexes := compilePatterns(patterns)
+
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !matchesAny(regexes, line) {
+			out = append(out, line)
 		}
 	}
+	return out
+}
+
+func applyKeep(lines []string, patterns []string, ctx KeepContext) []string {
+	regexes := compilePatterns(patterns)
 
+	w := newKeepWindow(ctx)
 	out := make([]string, 0, len(lines))
 	for _, line := range lines {
-		for _, re := range regexes {
-			if re.MatchString(line) {
-				out = append(out, line)
-				break
-			}
-		}
+		out = append(out, w.push(line, matchesAny(regexes, line))...)
 	}
 	return out
 }
 
+// keepSeparator marks a gap between non-adjacent keep_context windows.
+const keepSeparator = "…"
+
+// keepWindow selects kept lines plus their keep_context, one line at a time,
+// like grep -B/-A: overlapping windows merge and a keepSeparator line goes
+// between windows that aren't adjacent.
+type keepWindow struct {
+	ctx       KeepContext
+	before    []string // recent unkept lines, candidates for before-context
+	afterLeft int      // lines still owed as after-context
+	pos       int      // index of the current line
+	lastOut   int      // index of the last line emitted, -1 if none
+}
+
+func newKeepWindow(ctx KeepContext) *keepWindow {
+	return &keepWindow{ctx: ctx, pos: -1, lastOut: -1}
+}
+
+// push feeds the next line and returns the lines to emit because of it.
+func (w *keepWindow) push(line string, matched bool) []string {
+	w.pos++
+	if matched {
+		var out []string
+		start := w.pos - len(w.before)
+		if w.ctx.isSet() && w.lastOut >= 0 && start > w.lastOut+1 {
+			out = append(out, keepSeparator)
+		}
+		out = append(out, w.before...)
+		out = append(out, line)
+		w.before = w.before[:0]
+		w.lastOut = w.pos
+		w.afterLeft = w.ctx.After
+		return out
+	}
+	if w.afterLeft > 0 {
+		w.afterLeft--
+		w.lastOut = w.pos
+		return []string{line}
+	}
+	if w.ctx.Before > 0 {
+		w.before = appendBounded(w.before, line, w.ctx.Before)
+	}
+	return nil
+}
+
 func applyReplace(lines []string, rules []ReplaceRule) []string {
-	type compiledRule struct {
-		re     *regexp.Regexp
-		output string
+	compiled := compileReplaceRules(rules)
+
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		out = append(out, replaceLine(compiled, line))
 	}
-	compiled := make([]compiledRule, 0, len(rules))
+	return out
+}
+
+type compiledReplace struct {
+	re     *regexp.Regexp
+	output *template
+}
+
+func compileReplaceRules(rules []ReplaceRule) []compiledReplace {
+	compiled := make([]compiledReplace, 0, len(rules))
 	for _, r := range rules {
 		if re, err := compileRegex(r.Pattern); err == nil {
-			compiled = append(compiled, compiledRule{re, r.Output})
+			compiled = append(compiled, compiledReplace{re, compileTemplate(r.Output)})
 		}
 	}
+	return compiled
+}
 
-	out := make([]string, 0, len(lines))
-	for _, line := range lines {
-		matched := false
-		for _, cr := range compiled {
-			if m := cr.re.FindStringSubmatch(line); m != nil {
-				replaced := cr.output
-				for i, group := range m {
-					replaced = strings.ReplaceAll(replaced, fmt.Sprintf("{%d}", i), group)
+// replaceLine applies the first matching rule to line, or returns it unchanged.
+func replaceLine(compiled []compiledReplace, line string) string {
+	for _, cr := range compiled {
+		if m := cr.re.FindStringSubmatch(line); m != nil {
+			return cr.output.render(matchVars(cr.re, m))
+		}
+	}
+	return line
+}
+
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	regexes := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		if re, err := compileRegex(p); err == nil {
+			regexes = append(regexes, re)
+		}
+	}
+	return regexes
+}
+
+func matchesAny(regexes []*regexp.Regexp, line string) bool {
+	for _, re := range regexes {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOutput renders the output of the first match_output rule that
+// matches raw. The template sees {output} and, for a matches rule, the
+// regex groups.
+func matchOutput(rules []MatchOutputRule, raw string) (string, bool) {
+	_, out, ok := matchOutputRule(rules, raw)
+	return out, ok
+}
+
+// matchOutputRule is matchOutput also returning the index of the rule.
+func matchOutputRule(rules []MatchOutputRule, raw string) (int, string, bool) {
+	for i, rule := range rules {
+		if rule.Contains != "" && strings.Contains(raw, rule.Contains) {
+			return i, renderMatchOutput(rule.Output, raw, nil, nil), true
+		}
+		if rule.Matches != "" {
+			if re, err := compileRegex(rule.Matches); err == nil {
+				if m := re.FindStringSubmatch(raw); m != nil {
+					return i, renderMatchOutput(rule.Output, raw, re, m), true
 				}
-				out = append(out, replaced)
-				matched = true
-				break
 			}
 		}
-		if !matched {
-			out = append(out, line)
-		}
 	}
-	return out
+	return 0, "", false
+}
+
+func renderMatchOutput(tmpl, raw string, re *regexp.Regexp, m []string) string {
+	return compileTemplate(tmpl).render(func(name string) (string, bool) {
+		if name == "output" {
+			return raw, true
+		}
+		if re == nil {
+			return "", false
+		}
+		return matchVars(re, m)(name)
+	})
 }
 
-func applyOutputBlock(block *OutputBlock, lines []string, full string) string {
+// applyOutputBlock renders an on_success / on_failure block. vars are the
+// template values besides {output}; {lines_omitted} defaults to the lines of
+// vars["lines_total"] that the block doesn't show.
+func applyOutputBlock(block *OutputBlock, lines []string, full string, vars map[string]string) string {
 	if block.StartAt != "" {
 		if re, err := compileRegex(block.StartAt); err == nil {
 			for i, line := range lines {
@@ -148,7 +451,7 @@ func applyOutputBlock(block *OutputBlock, lines []string, full string) string {
 		full = strings.Join(lines, "\n")
 	}
 	if len(block.Keep) > 0 {
-		lines = applyKeep(lines, block.Keep)
+		lines = applyKeep(lines, block.Keep, block.KeepContext)
 		full = strings.Join(lines, "\n")
 	}
 	if block.Tail > 0 && len(lines) > block.Tail {
@@ -160,7 +463,12 @@ func applyOutputBlock(block *OutputBlock, lines []string, full string) string {
 		full = strings.Join(lines, "\n")
 	}
 	if block.Output != "" {
-		return strings.ReplaceAll(block.Output, "{output}", full)
+		vars["output"] = full
+		if _, ok := vars["lines_omitted"]; !ok {
+			total, _ := strconv.Atoi(vars["lines_total"])
+			vars["lines_omitted"] = strconv.Itoa(max(total-countContent(lines), 0))
+		}
+		return compileTemplate(block.Output).render(mapVars(vars))
 	}
 	return full
 }
@@ -8,8 +8,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
-
-	"github.com/BurntSushi/toml"
+	"time"
 )
 
 //go:embed filters
@@ -17,21 +16,46 @@ var embeddedFilters embed.FS
 
 // Filter represents a parsed TOML filter definition.
 type Filter struct {
-	Command      StringOrSlice     `toml:"command"`
-	Run          string            `toml:"run"`
-	StripAnsi    bool              `toml:"strip_ansi"`
-	Skip         []string          `toml:"skip"`
-	Keep         []string          `toml:"keep"`
-	Replace      []ReplaceRule     `toml:"replace"`
-	MatchOutput  []MatchOutputRule `toml:"match_output"`
-	OnSuccess    *OutputBlock      `toml:"on_success"`
-	OnFailure    *OutputBlock      `toml:"on_failure"`
-	Variants     []Variant         `toml:"variant"`
+	Command     StringOrSlice     `toml:"command"`
+	Exclude     StringOrSlice     `toml:"command_exclude"`   // patterns of commands the filter doesn't handle
+	Priority    int               `toml:"priority"`          // wins over lower priorities, whatever the score
+	Run         string            `toml:"run"`               // command run instead, with {args} and {argv[n]}
+	RunNoArgs   bool              `toml:"run_when_no_args"`  // run only replaces a command without arguments
+	Conflicting []string          `toml:"conflicting_flags"` // arguments with which the original command runs
+	StripAnsi   bool              `toml:"strip_ansi"`
+	Stream      bool              `toml:"stream"`
+	Timeout     Duration          `toml:"timeout"`
+	Streams     string            `toml:"streams"` // "stdout", "stderr" or "both" (default)
+	SkipStdout  []string          `toml:"skip_stdout"`
+	SkipStderr  []string          `toml:"skip_stderr"`
+	KeepStdout  []string          `toml:"keep_stdout"`
+	KeepStderr  []string          `toml:"keep_stderr"`
+	StackTrace  *StackTraceBlock  `toml:"stacktrace"`
+	Diagnostics DiagnosticsBlock  `toml:"diagnostics"`
+	Diff        *DiffBlock        `toml:"diff"`
+	Skip        []string          `toml:"skip"`
+	Keep        []string          `toml:"keep"`
+	KeepContext KeepContext       `toml:"keep_context"`
+	Sections    []Section         `toml:"section"`
+	Table       *TableBlock       `toml:"table"`
+	Replace     []ReplaceRule     `toml:"replace"`
+	Collapse    []ReplaceRule     `toml:"collapse"` // pattern + normalizing output template
+	Dedupe      bool              `toml:"dedupe"`
+	Count       []CountRule       `toml:"count"`
+	JSON        *JSONBlock        `toml:"json"`
+	MatchOutput []MatchOutputRule `toml:"match_output"`
+	MaxTokens   int               `toml:"max_tokens"`
+	Important   []string          `toml:"important"` // regexes kept first under max_tokens
+	OnSuccess   *OutputBlock      `toml:"on_success"`
+	OnFailure   *OutputBlock      `toml:"on_failure"`
+	Variants    []Variant         `toml:"variant"`
 
 	// Metadata (not from TOML)
 	Name   string `toml:"-"`
 	Source string `toml:"-"` // "built-in" or "user"
 	Path   string `toml:"-"`
+	// Problems are the rules that can't be applied, as "line:col: key: message"
+	Problems []string `toml:"-"`
 }
 
 type ReplaceRule struct {
@@ -39,6 +63,15 @@ type ReplaceRule struct {
 	Output  string `toml:"output"`
 }
 
+// CountRule counts lines matching Pattern into the template variable Name.
+// With Sum set, the number in the first non-empty capture group is added
+// instead of 1.
+type CountRule struct {
+	Name    string `toml:"name"`
+	Pattern string `toml:"pattern"`
+	Sum     bool   `toml:"sum"`
+}
+
 type MatchOutputRule struct {
 	Contains string `toml:"contains"`
 	Matches  string `toml:"matches"`
@@ -46,12 +79,37 @@ type MatchOutputRule struct {
 }
 
 type OutputBlock struct {
-	Output  string   `toml:"output"`
-	Head    int      `toml:"head"`
-	Tail    int      `toml:"tail"`
-	Skip    []string `toml:"skip"`
-	Keep    []string `toml:"keep"`
-	StartAt string   `toml:"start_at"`
+	Output      string           `toml:"output"`
+	Head        int              `toml:"head"`
+	Tail        int              `toml:"tail"`
+	Skip        []string         `toml:"skip"`
+	Keep        []string         `toml:"keep"`
+	KeepContext KeepContext      `toml:"keep_context"`
+	StartAt     string           `toml:"start_at"`
+	TestReport  *TestReportBlock `toml:"test_report"`
+}
+
+// Section applies its own rules to every block of lines that begins with a
+// start match, e.g. each file of a diff or each failing test.
+type Section struct {
+	Start       string        `toml:"start"`
+	End         string        `toml:"end"` // optional; otherwise the next start or end of output
+	Skip        []string      `toml:"skip"`
+	Keep        []string      `toml:"keep"`
+	KeepContext KeepContext   `toml:"keep_context"`
+	Replace     []ReplaceRule `toml:"replace"`
+	Head        int           `toml:"head"`
+	Tail        int           `toml:"tail"`
+}
+
+// KeepContext keeps lines around each keep match, like grep -B / -A.
+type KeepContext struct {
+	Before int `toml:"before"`
+	After  int `toml:"after"`
+}
+
+func (c KeepContext) isSet() bool {
+	return c.Before > 0 || c.After > 0
 }
 
 type Variant struct {
@@ -60,8 +118,14 @@ type Variant struct {
 	Filter string        `toml:"filter"`
 }
 
+// VariantDetect holds the rules that select a variant. Each rule matches if
+// any of its entries does; all configured rules must match.
 type VariantDetect struct {
-	Files []string `toml:"files"`
+	Files           []string          `toml:"files"`            // paths that exist, relative to the command's cwd
+	Env             []string          `toml:"env"`              // "NAME" (set) or "NAME=value"
+	CommandContains []string          `toml:"command_contains"` // substrings of the full command
+	OutputContains  []string          `toml:"output_contains"`  // substrings of the raw output (checked after run)
+	FileContains    map[string]string `toml:"file_contains"`    // path → substring, e.g. "package.json" = "vitest"
 }
 
 // StringOrSlice handles TOML fields that can be a string or []string.
@@ -85,6 +149,26 @@ func (s *StringOrSlice) UnmarshalTOML(data interface{}) error {
 	return nil
 }
 
+// Duration is a time.Duration that decodes from a TOML string ("90s", "5m")
+// or an integer number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	case int64:
+		*d = Duration(time.Duration(v) * time.Second)
+	default:
+		return fmt.Errorf("expected duration string or seconds, got %T", data)
+	}
+	return nil
+}
+
 func userFilterDir() string {
 	cfg, err := os.UserConfigDir()
 	if err != nil {
@@ -122,6 +206,9 @@ func loadAllFilters() ([]Filter, error) {
 
 func loadFiltersFromFS(fsys fs.FS, root, source string, out map[string]Filter) error {
 	return fs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && strings.HasSuffix(path, fixtureDirSuffix) {
+			return fs.SkipDir // golden-file fixtures, not filters
+		}
 		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".toml") {
 			return err
 		}
@@ -141,6 +228,9 @@ func loadFiltersFromFS(fsys fs.FS, root, source string, out map[string]Filter) e
 
 func loadFiltersFromDisk(dir, source string, out map[string]Filter) error {
 	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && strings.HasSuffix(path, fixtureDirSuffix) {
+			return filepath.SkipDir // golden-file fixtures, not filters
+		}
 		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".toml") {
 			return err
 		}
@@ -159,11 +249,14 @@ func loadFiltersFromDisk(dir, source string, out map[string]Filter) error {
 	})
 }
 
+// parseFilter decodes a filter. Rules that can't be applied don't fail it:
+// they are listed in Problems and ignored at run time.
 func parseFilter(data []byte, name, source, path string) (Filter, error) {
-	var f Filter
-	if err := toml.Unmarshal(data, &f); err != nil {
+	f, problems, err := decodeFilter(data)
+	if err != nil {
 		return f, err
 	}
+	f.Problems = problemStrings(problems)
 	f.Name = name
 	f.Source = source
 	f.Path = path
@@ -223,23 +316,68 @@ func extractMatchCmd(cmdStr string) string {
 	return result
 }
 
-// matchFilter finds the best filter for a command string.
-func matchFilter(filters []Filter, cmdStr string) *Filter {
-	matchCmd := extractMatchCmd(cmdStr)
-
-	var best *Filter
-	bestScore := -1
+// matchCandidate is a filter whose command patterns match a command.
+type matchCandidate struct {
+	Filter   *Filter
+	Pattern  string // the best-scoring pattern
+	Score    int
+	Excluded string // the command_exclude pattern that rules the filter out, if any
+}
 
+// matchCandidates lists the filters matching the segment matchCmd, best
+// first: higher priority, then higher score, then filter name, so ties never
+// depend on load order. Excluded filters are listed after the others.
+func matchCandidates(filters []Filter, matchCmd string) []matchCandidate {
+	var candidates []matchCandidate
 	for i := range filters {
-		for _, pattern := range filters[i].Command {
-			score := matchScore(pattern, matchCmd)
-			if score > bestScore {
-				bestScore = score
-				best = &filters[i]
+		c := matchCandidate{Filter: &filters[i]}
+		c.Pattern, c.Score = bestPattern(&filters[i], matchCmd)
+		if c.Score < 0 {
+			continue
+		}
+		for _, pattern := range filters[i].Exclude {
+			if matchScore(pattern, matchCmd) >= 0 {
+				c.Excluded = pattern
+				break
 			}
 		}
+		candidates = append(candidates, c)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if (a.Excluded == "") != (b.Excluded == "") {
+			return a.Excluded == ""
+		}
+		if a.Filter.Priority != b.Filter.Priority {
+			return a.Filter.Priority > b.Filter.Priority
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.Filter.Name < b.Filter.Name
+	})
+	return candidates
+}
+
+// bestPattern returns the command pattern of f that matches matchCmd with
+// the highest score, and the score; -1 when none matches.
+func bestPattern(f *Filter, matchCmd string) (string, int) {
+	best, bestScore := "", -1
+	for _, pattern := range f.Command {
+		if score := matchScore(pattern, matchCmd); score > bestScore {
+			best, bestScore = pattern, score
+		}
+	}
+	return best, bestScore
+}
+
+// matchFilter finds the best filter for a command string.
+func matchFilter(filters []Filter, cmdStr string) *Filter {
+	candidates := matchCandidates(filters, extractMatchCmd(cmdStr))
+	if len(candidates) == 0 || candidates[0].Excluded != "" {
+		return nil
 	}
-	return best
+	return candidates[0].Filter
 }
 
 // matchScore returns how well a pattern matches a command.
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// fixtureDirSuffix marks a directory of golden-file fixtures that sits next to
+// a filter: filters/git/push.toml → filters/git/push.tests/*.toml.
+const fixtureDirSuffix = ".tests"
+
+// filterFixture is one golden-file test case for a filter.
+type filterFixture struct {
+	ExitCode int    `toml:"exit_code"`
+	Input    string `toml:"input"`  // stdout
+	Stderr   string `toml:"stderr"` // optional, printed after stdout
+	Expected string `toml:"expected"`
+
+	// Metadata (not from TOML)
+	Name string `toml:"-"`
+	Path string `toml:"-"`
+}
+
+func cmdTest(args []string) {
+	update := false
+	dir := ""
+	var names []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--update":
+			update = true
+		case "--dir":
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, "rt: usage: rt test [--update] [--dir <filters-dir>] [filter...]")
+				os.Exit(1)
+			}
+			i++
+			dir = args[i]
+		default:
+			names = append(names, args[i])
+		}
+	}
+
+	filters, err := loadAllFilters()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rt: error loading filters: %v\n", err)
+		os.Exit(1)
+	}
+
+	// --dir: test filters straight from a checkout (e.g. the repo's filters/),
+	// so edits are picked up without rebuilding and --update can write back.
+	if dir != "" {
+		filters, err = overlayFilterDir(filters, dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rt: error loading filters: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	selected := filters
+	if len(names) > 0 {
+		selected = nil
+		for _, name := range names {
+			f := findFilter(filters, name)
+			if f == nil {
+				fmt.Fprintf(os.Stderr, "rt: filter not found: %s\n", name)
+				os.Exit(1)
+			}
+			selected = append(selected, *f)
+		}
+	}
+
+	passed, failed, untested := 0, 0, 0
+	for i := range selected {
+		f := &selected[i]
+		fixtures, err := loadFixtures(f)
+		if err != nil {
+			fmt.Printf("FAIL  %s\n  %v\n", f.Name, err)
+			failed++
+			continue
+		}
+		if len(fixtures) == 0 {
+			untested++
+			if len(names) > 0 {
+				fmt.Printf("none  %s (no fixtures)\n", f.Name)
+			}
+			continue
+		}
+
+		for _, fx := range fixtures {
+			got := applyFilterResult(f, fx.result())
+			if normalizeFixture(got) == normalizeFixture(fx.Expected) {
+				passed++
+				continue
+			}
+			if update {
+				if err := writeFixture(f, fx, got); err != nil {
+					fmt.Printf("FAIL  %s/%s\n  %v\n", f.Name, fx.Name, err)
+					failed++
+					continue
+				}
+				fmt.Printf("upd   %s/%s\n", f.Name, fx.Name)
+				passed++
+				continue
+			}
+			failed++
+			fmt.Printf("FAIL  %s/%s\n", f.Name, fx.Name)
+			for _, d := range lineDiff(splitFixture(fx.Expected), splitFixture(got)) {
+				fmt.Printf("  %s\n", d)
+			}
+		}
+	}
+
+	fmt.Printf("\n%d passed, %d failed, %d filters without fixtures\n", passed, failed, untested)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// overlayFilterDir loads filters from dir on top of filters, replacing any
+// with the same name.
+func overlayFilterDir(filters []Filter, dir string) ([]Filter, error) {
+	byName := make(map[string]Filter, len(filters))
+	for _, f := range filters {
+		byName[f.Name] = f
+	}
+	if err := loadFiltersFromDisk(dir, "local", byName); err != nil {
+		return nil, err
+	}
+	out := make([]Filter, 0, len(byName))
+	for _, f := range byName {
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// loadFixtures returns the fixtures for a filter, sorted by file name.
+// Built-in fixtures come from the embedded FS; user and local ones from disk.
+func loadFixtures(f *Filter) ([]filterFixture, error) {
+	dir := strings.TrimSuffix(f.Path, ".toml") + fixtureDirSuffix
+
+	var matches []string
+	readFile := os.ReadFile
+	if f.Source == "built-in" {
+		matches, _ = fs.Glob(embeddedFilters, path.Join(dir, "*.toml"))
+		readFile = func(p string) ([]byte, error) { return fs.ReadFile(embeddedFilters, p) }
+	} else {
+		matches, _ = filepath.Glob(filepath.Join(dir, "*.toml"))
+	}
+
+	fixtures := make([]filterFixture, 0, len(matches))
+	for _, p := range matches {
+		data, err := readFile(p)
+		if err != nil {
+			return nil, err
+		}
+		fx, err := parseFixture(data, p)
+		if err != nil {
+			return nil, err
+		}
+		fixtures = append(fixtures, fx)
+	}
+
+	sort.Slice(fixtures, func(i, j int) bool {
+		return fixtures[i].Name < fixtures[j].Name
+	})
+	return fixtures, nil
+}
+
+// result builds the captured output a fixture describes: stdout lines
+// followed by stderr lines.
+func (fx filterFixture) result() runResult {
+	if fx.Stderr == "" {
+		return textResult(fx.Input, fx.ExitCode)
+	}
+	stdout := splitLines(fx.Input)
+	stderr := splitLines(fx.Stderr)
+	origin := make([]bool, len(stdout)+len(stderr))
+	for i := len(stdout); i < len(origin); i++ {
+		origin[i] = true
+	}
+	return runResult{
+		Output:      strings.Join(append(stdout, stderr...), "\n") + "\n",
+		Stdout:      fx.Input,
+		Stderr:      fx.Stderr,
+		ExitCode:    fx.ExitCode,
+		stderrLines: origin,
+	}
+}
+
+func parseFixture(data []byte, p string) (filterFixture, error) {
+	var fx filterFixture
+	if _, err := toml.Decode(string(data), &fx); err != nil {
+		return fx, fmt.Errorf("parsing %s: %w", p, err)
+	}
+	fx.Name = strings.TrimSuffix(path.Base(filepath.ToSlash(p)), ".toml")
+	fx.Path = p
+	return fx, nil
+}
+
+// writeFixture rewrites a fixture with a new expected output, keeping its
+// leading comment block. Built-in fixtures live in the binary, so they can
+// only be updated via --dir.
+func writeFixture(f *Filter, fx filterFixture, got string) error {
+	if f.Source == "built-in" {
+		return fmt.Errorf("cannot update built-in fixture %s (use --dir filters)", fx.Path)
+	}
+
+	var buf strings.Builder
+	if old, err := os.ReadFile(fx.Path); err == nil {
+		for _, line := range strings.Split(string(old), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				break
+			}
+			buf.WriteString(line + "\n")
+		}
+	}
+	fmt.Fprintf(&buf, "exit_code = %d\n", fx.ExitCode)
+	fmt.Fprintf(&buf, "input = %s\n", tomlMultiline(fx.Input))
+	if fx.Stderr != "" {
+		fmt.Fprintf(&buf, "stderr = %s\n", tomlMultiline(fx.Stderr))
+	}
+	fmt.Fprintf(&buf, "expected = %s\n", tomlMultiline(got))
+	return os.WriteFile(fx.Path, []byte(buf.String()), 0o644)
+}
+
+// tomlMultiline renders s as a readable TOML multi-line string: a literal
+// string when possible, a basic string with escapes otherwise.
+func tomlMultiline(s string) string {
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	literal := !strings.Contains(s, "'''")
+	for _, r := range s {
+		if (r < 0x20 && r != '\n' && r != '\t') || r == 0x7f {
+			literal = false
+			break
+		}
+	}
+	if literal {
+		return "'''\n" + s + "'''"
+	}
+
+	var b strings.Builder
+	b.WriteString(`"""` + "\n")
+	for _, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\n' || r == '\t':
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteString(`"""`)
+	return b.String()
+}
+
+// normalizeFixture ignores trailing newlines, which TOML multi-line strings
+// make awkward to control.
+func normalizeFixture(s string) string {
+	return strings.TrimRight(s, "\n")
+}
+
+func splitFixture(s string) []string {
+	s = normalizeFixture(s)
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// lineDiff returns a minimal line diff of want → got, with "-" for lines
+// only in want, "+" for lines only in got and " " for common lines.
+func lineDiff(want, got []string) []string {
+	// LCS table: lcs[i][j] = LCS length of want[i:] and got[j:]
+	lcs := make([][]int, len(want)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(got)+1)
+	}
+	for i := len(want) - 1; i >= 0; i-- {
+		for j := len(got) - 1; j >= 0; j-- {
+			if want[i] == got[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(want) && j < len(got) {
+		switch {
+		case want[i] == got[j]:
+			out = append(out, "  "+want[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+want[i])
+			i++
+		default:
+			out = append(out, "+ "+got[j])
+			j++
+		}
+	}
+	for ; i < len(want); i++ {
+		out = append(out, "- "+want[i])
+	}
+	for ; j < len(got); j++ {
+		out = append(out, "+ "+got[j])
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestBuiltinFixtures runs every built-in filter's golden-file fixtures, as
+// rt test does.
+func TestBuiltinFixtures(t *testing.T) {
+	byName := make(map[string]Filter)
+	if err := loadFiltersFromFS(embeddedFilters, "filters", "built-in", byName); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	total := 0
+	for _, name := range names {
+		f := byName[name]
+		fixtures, err := loadFixtures(&f)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		for _, fx := range fixtures {
+			total++
+			t.Run(name+"/"+fx.Name, func(t *testing.T) {
+				got := applyFilterResult(&f, fx.result())
+				if normalizeFixture(got) != normalizeFixture(fx.Expected) {
+					diff := lineDiff(splitFixture(fx.Expected), splitFixture(got))
+					t.Errorf("output differs from %s:\n%s", fx.Path, strings.Join(diff, "\n"))
+				}
+			})
+		}
+	}
+	if total == 0 {
+		t.Fatal("no fixtures found")
+	}
+}
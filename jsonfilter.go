@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// JSONBlock is the [json] section: structured filtering for commands that
+// print JSON. When the output doesn't parse, the line pipeline runs instead.
+type JSONBlock struct {
+	Root      string   `toml:"root"`       // path to the values to render, e.g. ".items[]" (default ".")
+	Fields    []string `toml:"fields"`     // ".path" or "name=.path"; projects each value to these fields
+	MaxItems  int      `toml:"max_items"`  // truncate arrays (and the list of results) to this many items
+	DropEmpty bool     `toml:"drop_empty"` // drop fields that are null, "", [] or {}
+	Format    string   `toml:"format"`     // "json" (compact, default) or "tsv"
+}
+
+// jsonObject is a decoded JSON object that keeps its keys in source order.
+type jsonObject []jsonField
+
+type jsonField struct {
+	Key   string
+	Value any
+}
+
+func (o jsonObject) get(key string) (any, bool) {
+	for _, f := range o {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// applyJSON renders output through a [json] block. ok is false when the
+// output isn't JSON, the block's paths are invalid or root selects nothing
+// (say, a bare number where a list was expected), so the caller can fall
+// back to the line pipeline.
+func applyJSON(block *JSONBlock, output string) (lines []string, ok bool) {
+	docs, err := decodeJSONDocs(output)
+	if err != nil || len(docs) == 0 {
+		return nil, false
+	}
+
+	root, err := parseJSONPath(block.Root)
+	if err != nil {
+		return nil, false
+	}
+	fields, err := parseJSONFields(block.Fields)
+	if err != nil {
+		return nil, false
+	}
+
+	var results []any
+	for _, doc := range docs {
+		results = append(results, root.eval(doc)...)
+	}
+	if len(results) == 0 {
+		return nil, false
+	}
+	if len(fields) > 0 {
+		for i, v := range results {
+			results[i] = fields.project(v)
+		}
+	}
+	for i, v := range results {
+		if block.DropEmpty {
+			v, _ = dropEmpty(v)
+		}
+		results[i] = truncateArrays(v, block.MaxItems)
+	}
+
+	omitted := 0
+	if block.MaxItems > 0 && len(results) > block.MaxItems {
+		omitted = len(results) - block.MaxItems
+		results = results[:block.MaxItems]
+	}
+
+	if block.Format == "tsv" {
+		lines = renderTSV(results, fields)
+	} else {
+		for _, v := range results {
+			lines = append(lines, compactJSON(v))
+		}
+	}
+	if omitted > 0 {
+		lines = append(lines, fmt.Sprintf("… %d more", omitted))
+	}
+	return lines, true
+}
+
+// decodeJSONDocs decodes one JSON document, or several concatenated ones
+// (JSON Lines), keeping object key order and exact number text.
+func decodeJSONDocs(s string) ([]any, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var docs []any
+	for {
+		v, err := decodeJSONValue(dec)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, v)
+	}
+}
+
+func decodeJSONValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := jsonObject{}
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := keyTok.(string)
+			val, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, jsonField{key, val})
+		}
+		_, err := dec.Token() // '}'
+		return obj, err
+	case json.Delim('['):
+		arr := []any{}
+		for dec.More() {
+			val, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+		}
+		_, err := dec.Token() // ']'
+		return arr, err
+	case json.Delim('}'), json.Delim(']'):
+		return nil, fmt.Errorf("unexpected %v", tok)
+	}
+	return tok, nil
+}
+
+// jsonPath is a parsed path in the jq subset we support: .a.b, ."quoted key",
+// .["quoted key"], .a[0], .a[-1] and .a[] (iterate).
+type jsonPath []jsonStep
+
+type jsonStep struct {
+	key   string
+	index int
+	kind  byte // 'k' key, 'i' index, '*' iterate
+}
+
+func parseJSONPath(s string) (jsonPath, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "." {
+		return nil, nil
+	}
+	if s[0] != '.' {
+		return nil, fmt.Errorf("path %q must start with '.'", s)
+	}
+
+	var path jsonPath
+	i := 0
+	for i < len(s) {
+		switch {
+		case s[i] == '.' && i+1 < len(s) && s[i+1] == '"':
+			key, n, err := readQuotedKey(s[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, jsonStep{kind: 'k', key: key})
+			i += 1 + n
+		case s[i] == '.' && i+1 < len(s) && s[i+1] == '[':
+			i++ // ".[...]" is the same as "[...]"
+		case s[i] == '.':
+			j := i + 1
+			for j < len(s) && s[j] != '.' && s[j] != '[' {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("empty key in path %q", s)
+			}
+			path = append(path, jsonStep{kind: 'k', key: s[i+1 : j]})
+			i = j
+		case s[i] == '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed '[' in path %q", s)
+			}
+			inner := s[i+1 : i+end]
+			switch {
+			case inner == "":
+				path = append(path, jsonStep{kind: '*'})
+			case inner[0] == '"':
+				key, n, err := readQuotedKey(inner)
+				if err != nil || n != len(inner) {
+					return nil, fmt.Errorf("invalid key %s in path %q", inner, s)
+				}
+				path = append(path, jsonStep{kind: 'k', key: key})
+			default:
+				idx, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index [%s] in path %q", inner, s)
+				}
+				path = append(path, jsonStep{kind: 'i', index: idx})
+			}
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("unexpected %q in path %q", s[i], s)
+		}
+	}
+	return path, nil
+}
+
+// readQuotedKey reads a JSON string literal at the start of s and returns it
+// with the number of bytes consumed.
+func readQuotedKey(s string) (string, int, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	var key string
+	if err := dec.Decode(&key); err != nil {
+		return "", 0, fmt.Errorf("invalid quoted key in %q", s)
+	}
+	return key, int(dec.InputOffset()), nil
+}
+
+// eval returns every value the path selects from v. Missing keys and out of
+// range indices select null, like jq; iterating a non-array selects nothing.
+func (p jsonPath) eval(v any) []any {
+	vals := []any{v}
+	for _, step := range p {
+		var next []any
+		for _, cur := range vals {
+			switch step.kind {
+			case 'k':
+				obj, _ := cur.(jsonObject)
+				val, _ := obj.get(step.key)
+				next = append(next, val)
+			case 'i':
+				arr, _ := cur.([]any)
+				idx := step.index
+				if idx < 0 {
+					idx += len(arr)
+				}
+				if idx >= 0 && idx < len(arr) {
+					next = append(next, arr[idx])
+				} else {
+					next = append(next, nil)
+				}
+			case '*':
+				switch c := cur.(type) {
+				case []any:
+					next = append(next, c...)
+				case jsonObject:
+					for _, f := range c {
+						next = append(next, f.Value)
+					}
+				}
+			}
+		}
+		vals = next
+	}
+	return vals
+}
+
+// iterates reports whether the path can select more than one value.
+func (p jsonPath) iterates() bool {
+	for _, step := range p {
+		if step.kind == '*' {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonFields []jsonProjection
+
+type jsonProjection struct {
+	name string
+	path jsonPath
+}
+
+// parseJSONFields parses "name=.path" or ".path" entries. Without a name the
+// last key of the path is used.
+func parseJSONFields(specs []string) (jsonFields, error) {
+	var fields jsonFields
+	for _, spec := range specs {
+		name, expr, named := strings.Cut(spec, "=")
+		if !named || strings.HasPrefix(strings.TrimSpace(name), ".") {
+			name, expr = "", spec
+		}
+		path, err := parseJSONPath(expr)
+		if err != nil {
+			return nil, err
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			for i := len(path) - 1; i >= 0; i-- {
+				if path[i].kind == 'k' {
+					name = path[i].key
+					break
+				}
+			}
+		}
+		if name == "" {
+			name = strings.TrimSpace(expr)
+		}
+		fields = append(fields, jsonProjection{name, path})
+	}
+	return fields, nil
+}
+
+// project builds an object with one entry per field. A path that iterates
+// yields an array.
+func (fs jsonFields) project(v any) any {
+	obj := make(jsonObject, 0, len(fs))
+	for _, f := range fs {
+		vals := f.path.eval(v)
+		var val any
+		if f.path.iterates() {
+			val = vals
+		} else if len(vals) > 0 {
+			val = vals[0]
+		}
+		obj = append(obj, jsonField{f.name, val})
+	}
+	return obj
+}
+
+// dropEmpty removes object fields that are null, "", [] or {} (after their
+// own contents are cleaned). It reports whether v itself is empty.
+func dropEmpty(v any) (any, bool) {
+	switch c := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return c, c == ""
+	case []any:
+		out := make([]any, len(c))
+		for i, item := range c {
+			out[i], _ = dropEmpty(item)
+		}
+		return out, len(out) == 0
+	case jsonObject:
+		out := jsonObject{}
+		for _, f := range c {
+			if val, empty := dropEmpty(f.Value); !empty {
+				out = append(out, jsonField{f.Key, val})
+			}
+		}
+		return out, len(out) == 0
+	}
+	return v, false
+}
+
+// truncateArrays cuts every array longer than max down to max items plus a
+// "… N more" marker. max <= 0 leaves arrays alone.
+func truncateArrays(v any, max int) any {
+	if max <= 0 {
+		return v
+	}
+	switch c := v.(type) {
+	case []any:
+		n := len(c)
+		if n > max {
+			c = c[:max]
+		}
+		out := make([]any, 0, len(c)+1)
+		for _, item := range c {
+			out = append(out, truncateArrays(item, max))
+		}
+		if n > max {
+			out = append(out, fmt.Sprintf("… %d more", n-max))
+		}
+		return out
+	case jsonObject:
+		out := make(jsonObject, len(c))
+		for i, f := range c {
+			out[i] = jsonField{f.Key, truncateArrays(f.Value, max)}
+		}
+		return out
+	}
+	return v
+}
+
+func compactJSON(v any) string {
+	var b bytes.Buffer
+	writeJSON(&b, v)
+	return b.String()
+}
+
+func writeJSON(b *bytes.Buffer, v any) {
+	switch c := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(c))
+	case json.Number:
+		b.WriteString(c.String())
+	case string:
+		writeJSONString(b, c)
+	case []any:
+		b.WriteByte('[')
+		for i, item := range c {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSON(b, item)
+		}
+		b.WriteByte(']')
+	case jsonObject:
+		b.WriteByte('{')
+		for i, f := range c {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONString(b, f.Key)
+			b.WriteByte(':')
+			writeJSON(b, f.Value)
+		}
+		b.WriteByte('}')
+	}
+}
+
+func writeJSONString(b *bytes.Buffer, s string) {
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	b.Truncate(b.Len() - 1) // Encode adds a newline
+}
+
+// renderTSV renders results as a header row plus one row per result. The
+// columns are the projected fields, or the keys of the objects in order of
+// first appearance. Nested values are written as compact JSON.
+func renderTSV(results []any, fields jsonFields) []string {
+	var columns []string
+	if len(fields) > 0 {
+		for _, f := range fields {
+			columns = append(columns, f.name)
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, r := range results {
+			obj, _ := r.(jsonObject)
+			for _, f := range obj {
+				if !seen[f.Key] {
+					seen[f.Key] = true
+					columns = append(columns, f.Key)
+				}
+			}
+		}
+	}
+
+	// Not objects: one value per line
+	if len(columns) == 0 {
+		lines := make([]string, 0, len(results))
+		for _, r := range results {
+			lines = append(lines, tsvCell(r))
+		}
+		return lines
+	}
+
+	lines := []string{strings.Join(columns, "\t")}
+	for _, r := range results {
+		obj, _ := r.(jsonObject)
+		cells := make([]string, len(columns))
+		for i, col := range columns {
+			val, _ := obj.get(col)
+			cells[i] = tsvCell(val)
+		}
+		lines = append(lines, strings.Join(cells, "\t"))
+	}
+	return lines
+}
+
+func tsvCell(v any) string {
+	var s string
+	switch c := v.(type) {
+	case nil:
+		return ""
+	case string:
+		s = c
+	case json.Number:
+		s = c.String()
+	case bool:
+		s = strconv.FormatBool(c)
+	default:
+		s = compactJSON(c)
+	}
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", "").Replace(s)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LogTemplates is the log_templates setting of config.toml: passthrough
+// output of at least MinLines lines is compressed by mining log templates.
+// It decodes from `log_templates = true` or from a [log_templates] table.
+type LogTemplates struct {
+	Enabled  bool
+	MinLines int // lines from which passthrough output is compressed (default 200)
+}
+
+const (
+	defaultLogTemplateLines = 200
+	// logSimilarity is the share of a template's fixed tokens a line must
+	// match to join it.
+	logSimilarity = 0.5
+	// logWildcard stands for a variable token in a template.
+	logWildcard = "<*>"
+)
+
+func (l *LogTemplates) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case bool:
+		l.Enabled = v
+	case map[string]interface{}:
+		l.Enabled = true
+		for key, value := range v {
+			switch key {
+			case "min_lines":
+				n, ok := value.(int64)
+				if !ok {
+					return fmt.Errorf("log_templates.min_lines: expected integer, got %T", value)
+				}
+				l.MinLines = int(n)
+			default:
+				return fmt.Errorf("log_templates: unknown key %q", key)
+			}
+		}
+	default:
+		return fmt.Errorf("expected true or a table, got %T", data)
+	}
+	return nil
+}
+
+// applies reports whether output of this many lines is compressed.
+func (l LogTemplates) applies(lines int) bool {
+	if !l.Enabled {
+		return false
+	}
+	min := l.MinLines
+	if min <= 0 {
+		min = defaultLogTemplateLines
+	}
+	return lines >= min
+}
+
+// logTemplate is a cluster of lines that differ only in variable tokens.
+type logTemplate struct {
+	tokens  []string // logWildcard where the lines differ
+	count   int
+	example string // the first line of the cluster
+}
+
+// logMiner groups lines into templates the way Drain does: lines are split
+// into tokens, bucketed by token count and first token, and each joins the
+// most similar template of its bucket if enough of the template's fixed
+// tokens match, turning the tokens that differ into wildcards. Tokens with
+// digits (ids, timestamps, durations, addresses) are wildcards up front.
+type logMiner struct {
+	important []*regexp.Regexp
+	buckets   map[string][]*logTemplate
+	entries   []logEntry // output order: templates at their first line
+}
+
+// logEntry is a template, or a line that is kept as is.
+type logEntry struct {
+	template *logTemplate
+	line     string
+}
+
+func newLogMiner(important []string) *logMiner {
+	return &logMiner{
+		important: compilePatterns(important),
+		buckets:   make(map[string][]*logTemplate),
+	}
+}
+
+func (m *logMiner) add(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if matchesAny(m.important, line) {
+		m.entries = append(m.entries, logEntry{line: line})
+		return
+	}
+	tokens := strings.Fields(line)
+	for i, tok := range tokens {
+		if strings.ContainsAny(tok, "0123456789") {
+			tokens[i] = logWildcard
+		}
+	}
+	key := strconv.Itoa(len(tokens)) + " " + tokens[0]
+
+	var best *logTemplate
+	bestScore := -1.0
+	for _, t := range m.buckets[key] {
+		if score := templateSimilarity(t.tokens, tokens); score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+	if best == nil || bestScore < logSimilarity {
+		t := &logTemplate{tokens: tokens, count: 1, example: line}
+		m.buckets[key] = append(m.buckets[key], t)
+		m.entries = append(m.entries, logEntry{template: t})
+		return
+	}
+	for i, tok := range tokens {
+		if best.tokens[i] != tok {
+			best.tokens[i] = logWildcard
+		}
+	}
+	best.count++
+}
+
+// templateSimilarity is the share of the template's fixed tokens that the
+// line repeats in the same position; a template of wildcards matches all.
+func templateSimilarity(template, tokens []string) float64 {
+	fixed, same := 0, 0
+	for i, tok := range template {
+		if tok == logWildcard {
+			continue
+		}
+		fixed++
+		if tokens[i] == tok {
+			same++
+		}
+	}
+	if fixed == 0 {
+		return 1
+	}
+	return float64(same) / float64(fixed)
+}
+
+// render prints each template once, where its first line was: a single line
+// as is, repeats as "line (×N)", and a template with wildcards as
+// "template (×N)" followed by its first line as an example. Kept lines
+// print in place.
+func (m *logMiner) render() []string {
+	var out []string
+	for _, e := range m.entries {
+		t := e.template
+		switch {
+		case t == nil:
+			out = append(out, e.line)
+		case t.count == 1:
+			out = append(out, t.example)
+		case !containsWildcard(t.tokens):
+			out = append(out, fmt.Sprintf("%s (×%d)", t.example, t.count))
+		default:
+			out = append(out, fmt.Sprintf("%s (×%d)", strings.Join(t.tokens, " "), t.count))
+			out = append(out, "  e.g. "+strings.TrimSpace(t.example))
+		}
+	}
+	return out
+}
+
+func containsWildcard(tokens []string) bool {
+	for _, tok := range tokens {
+		if tok == logWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// mineLogTemplates compresses output into its log templates, keeping the
+// lines that match an important pattern (errors, warnings) as they are.
+func mineLogTemplates(lines []string, important []string) []string {
+	m := newLogMiner(important)
+	for _, line := range lines {
+		m.add(line)
+	}
+	return m.render()
+}
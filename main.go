@@ -16,12 +16,24 @@ func main() {
 	switch os.Args[1] {
 	case "run":
 		cmdRun(os.Args[2:])
+	case "filter":
+		cmdFilter(os.Args[2:])
+	case "which":
+		cmdWhich(os.Args[2:])
+	case "last":
+		cmdLast(os.Args[2:])
+	case "raw":
+		cmdRaw(os.Args[2:])
 	case "ls":
 		cmdLs()
 	case "show":
 		cmdShow(os.Args[2:])
 	case "check":
 		cmdCheck(os.Args[2:])
+	case "test":
+		cmdTest(os.Args[2:])
+	case "trace":
+		cmdTrace(os.Args[2:])
 	case "gain":
 		cmdGain(os.Args[2:])
 	case "add":
@@ -55,10 +67,16 @@ func printUsage() {
 Usage: rt <command> [args...]
 
 Commands:
-  run <cmd...>       Run a command and filter its output
+  run <cmd...>       Run a command and filter its output (--timeout <dur>, --trace)
+  filter <filter>    Filter saved output from a file or stdin (--exit-code N, --as "<cmd>")
+  last               Show the filtered output of the last run (--raw, --grep <re>, --lines a:b)
+  raw <id>           Show the unfiltered output of a run (--grep <re>, --lines a:b)
   ls                 List available filters
+  which <cmd...>     Show which filter a command would use, and why
   show <filter>      Show filter TOML source
-  check <file>       Validate a filter TOML file
+  check <file>       Validate a filter TOML file (regexes, templates, keys)
+  test [filter...]   Run filter golden-file fixtures (--update, --dir <dir>)
+  trace <filter>     Show what each stage of a filter does to stdin (--exit N, --side-by-side)
   gain [--by-filter|--log] Show token savings statistics
   add <file|url>     Install a filter
   eject <filter>     Copy built-in filter to user dir for customization
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// runPlaceholderRe matches the placeholders of a run template: {args}, the
+// arguments after the words of the command pattern, and {argv[n]}, the
+// nth word of the command (argv[0] is the program).
+var runPlaceholderRe = regexp.MustCompile(`\{(args|argv\[(\d+)\])\}`)
+
+// patternPrefixLen is the number of literal words a command pattern starts
+// with: 2 for "git log" and for "npm run *".
+func patternPrefixLen(pattern string) int {
+	n := 0
+	for _, word := range strings.Fields(pattern) {
+		if word == "*" {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// conflictingFlag returns the first argument that is one of flags, as is or
+// as --flag=value, or "" if there is none. Arguments after "--" are paths.
+func conflictingFlag(args, flags []string) string {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		for _, flag := range flags {
+			if arg == flag || strings.HasPrefix(flag, "--") && strings.HasPrefix(arg, flag+"=") {
+				return arg
+			}
+		}
+	}
+	return ""
+}
+
+// runOverride renders the filter's run command for a command made of words
+// and matched by pattern. It returns false when the original command must
+// run instead: run_when_no_args is set and there are arguments, an argument
+// is one of conflicting_flags, or the template needs an {argv[n]} the
+// command doesn't have. Words are shell-quoted as they are substituted.
+func runOverride(f *Filter, pattern string, words []string) (string, bool) {
+	args := words[min(patternPrefixLen(pattern), len(words)):]
+	if f.RunNoArgs && len(args) > 0 {
+		return "", false
+	}
+	if conflictingFlag(args, f.Conflicting) != "" {
+		return "", false
+	}
+
+	ok := true
+	run := runPlaceholderRe.ReplaceAllStringFunc(f.Run, func(m string) string {
+		sub := runPlaceholderRe.FindStringSubmatch(m)
+		if sub[1] == "args" {
+			return shellJoin(args)
+		}
+		n, _ := strconv.Atoi(sub[2])
+		if n >= len(words) {
+			ok = false
+			return m
+		}
+		return shellEscape(words[n])
+	})
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSpace(run), true
+}
+
+func shellJoin(words []string) string {
+	escaped := make([]string, len(words))
+	for i, w := range words {
+		escaped[i] = shellEscape(w)
+	}
+	return strings.Join(escaped, " ")
+}
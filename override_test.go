@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestRunOverride(t *testing.T) {
+	gitLog := &Filter{
+		Run:         "git log --oneline -20 {args}",
+		Conflicting: []string{"-p", "--stat", "--format"},
+	}
+	tests := []struct {
+		name    string
+		f       *Filter
+		pattern string
+		words   []string
+		want    string
+		ok      bool
+	}{
+		{"no args", gitLog, "git log", []string{"git", "log"}, "git log --oneline -20", true},
+		{"args kept", gitLog, "git log", []string{"git", "log", "--author=bob", "src/"},
+			"git log --oneline -20 --author=bob src/", true},
+		{"args quoted", gitLog, "git log", []string{"git", "log", "--grep", "two words", "it's"},
+			`git log --oneline -20 --grep 'two words' 'it'\''s'`, true},
+		{"conflicting flag", gitLog, "git log", []string{"git", "log", "-p"}, "", false},
+		{"conflicting flag with value", gitLog, "git log", []string{"git", "log", "--format=%H"}, "", false},
+		{"flag after --", gitLog, "git log", []string{"git", "log", "--", "--stat"},
+			"git log --oneline -20 -- --stat", true},
+		{"argv", &Filter{Run: "npm run {argv[2]} --silent"}, "npm run *", []string{"npm", "run", "build", "--watch"},
+			"npm run build --silent", true},
+		{"argv missing", &Filter{Run: "npm run {argv[2]}"}, "npm run", []string{"npm", "run"}, "", false},
+		{"args after wildcard prefix", &Filter{Run: "npm run {args} --silent"}, "npm run *", []string{"npm", "run", "build", "--watch"},
+			"npm run build --watch --silent", true},
+		{"when no args, without args", &Filter{Run: "git status -sb", RunNoArgs: true}, "git status", []string{"git", "status"},
+			"git status -sb", true},
+		{"when no args, with args", &Filter{Run: "git status -sb", RunNoArgs: true}, "git status", []string{"git", "status", "src"},
+			"", false},
+		{"no placeholders drops args", &Filter{Run: "git status -sb"}, "git status", []string{"git", "status", "src"},
+			"git status -sb", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := runOverride(tt.f, tt.pattern, tt.words)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("runOverride(%q, %q) = %q, %v; want %q, %v", tt.f.Run, tt.words, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestConflictingFlag(t *testing.T) {
+	flags := []string{"-p", "--stat", "-v"}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"--author=bob"}, ""},
+		{[]string{"-n", "5", "-p"}, "-p"},
+		{[]string{"--stat=80"}, "--stat=80"},
+		{[]string{"--statistics"}, ""},
+		{[]string{"-pv"}, ""},  // bundled short flags aren't split
+		{[]string{"-v=1"}, ""}, // only long flags take =value
+		{[]string{"--", "-p"}, ""},
+	}
+	for _, tt := range tests {
+		if got := conflictingFlag(tt.args, flags); got != tt.want {
+			t.Errorf("conflictingFlag(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// TestBuiltinRunOverrides runs the run templates of the built-in filters
+// that replace the command, which the golden-file fixtures don't cover.
+func TestBuiltinRunOverrides(t *testing.T) {
+	// Built-in filters only, whatever is installed in the user's config
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	filters, err := loadAllFilters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cmd  string
+		want string // "" when the command runs as written
+	}{
+		{"git log", "git log --oneline -20"},
+		{"git log --author=bob src/", "git log --oneline -20 --author=bob src/"},
+		{"git log -p -1", ""},
+		{"git log --format=%an", ""},
+		{"git status", "git status --porcelain -b"},
+		{"git status src", "git status --porcelain -b src"},
+		{"git status -v", ""},
+		{"git status --porcelain=v2", ""},
+	}
+	for _, tt := range tests {
+		f := matchFilter(filters, tt.cmd)
+		if f == nil {
+			t.Fatalf("%s: no filter", tt.cmd)
+		}
+		pattern, _ := bestPattern(f, tt.cmd)
+		got, ok := runOverride(f, pattern, shellSplit(tt.cmd))
+		if !ok {
+			got = ""
+		}
+		if got != tt.want {
+			t.Errorf("%s: run %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// forwardedSignals are relayed from rt to the running command.
+var forwardedSignals = []os.Signal{os.Interrupt}
+
+// setProcessGroup is a no-op where process groups aren't available.
+func setProcessGroup(cmd *exec.Cmd) (restore func()) {
+	return func() {}
+}
+
+// forwardSignal delivers sig to the command. Only os.Kill is supported on
+// every platform, so anything else ends the process too.
+func forwardSignal(cmd *exec.Cmd, sig os.Signal) {
+	if cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+}
+
+// terminate ends the command.
+func terminate(cmd *exec.Cmd) {
+	forwardSignal(cmd, os.Kill)
+}
@@ -0,0 +1,88 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+
+	"github.com/mattn/go-isatty"
+)
+
+// forwardedSignals are relayed from rt to the running command.
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// setProcessGroup puts the command in its own process group so a signal or
+// timeout reaches every process it spawned, not just the shell.
+//
+// When rt runs in the foreground of a terminal, the group is also made the
+// terminal's foreground group: a background group reading the TTY would be
+// stopped with SIGTTIN, and Ctrl-C then goes to the command as it would
+// without rt. Call restore once the command has exited (or failed to start)
+// to hand the terminal back; otherwise rt is left in the background, and its
+// next terminal read or write stops it with SIGTTIN or SIGTTOU.
+func setProcessGroup(cmd *exec.Cmd) (restore func()) {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	cmd.SysProcAttr = attr
+	if !stdinIsTerminal() {
+		return func() {}
+	}
+	fd := int(os.Stdin.Fd())
+	fg, err := tcgetpgrp(fd)
+	if err != nil || fg != syscall.Getpgrp() {
+		return func() {}
+	}
+	attr.Foreground = true
+	attr.Ctty = fd
+	return func() { tcsetpgrp(fd, fg) }
+}
+
+func tcgetpgrp(fd int) (int, error) {
+	var pgrp int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
+
+func tcsetpgrp(fd, pgrp int) {
+	// rt is in a background group until this returns, and a background
+	// group taking the terminal is sent SIGTTOU
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	p := int32(pgrp)
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&p)))
+}
+
+func ownGroup(cmd *exec.Cmd) bool {
+	return cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid
+}
+
+// forwardSignal delivers sig to the command's process group, or to the
+// command alone when it has none (it was never started).
+func forwardSignal(cmd *exec.Cmd, sig os.Signal) {
+	if cmd.Process == nil {
+		return
+	}
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return
+	}
+	if ownGroup(cmd) {
+		_ = syscall.Kill(-cmd.Process.Pid, s)
+		return
+	}
+	_ = cmd.Process.Signal(s)
+}
+
+// terminate asks the command (and its group) to exit.
+func terminate(cmd *exec.Cmd) {
+	forwardSignal(cmd, syscall.SIGTERM)
+}
+
+func stdinIsTerminal() bool {
+	return isatty.IsTerminal(os.Stdin.Fd())
+}
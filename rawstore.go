@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// rawStoreMaxBytes bounds the raw output store as a whole; the oldest runs
+	// are removed first.
+	rawStoreMaxBytes = 64 << 20
+	// rawRunMaxBytes bounds the raw output kept for a single run.
+	rawRunMaxBytes = 8 << 20
+)
+
+// rawStoreDir holds the output of recent runs, named after their id in the
+// runs table: raw/37.log is the unfiltered output and raw/37.out what the
+// filter printed.
+func rawStoreDir() string {
+	return filepath.Join(filepath.Dir(statsDBPath()), "raw")
+}
+
+func rawPath(id int64) string {
+	return filepath.Join(rawStoreDir(), strconv.FormatInt(id, 10)+".log")
+}
+
+func filteredPath(id int64) string {
+	return filepath.Join(rawStoreDir(), strconv.FormatInt(id, 10)+".out")
+}
+
+// rawWriter saves a run's unfiltered output. It writes to a temporary file
+// because the run id only exists once the run is recorded; commit then moves
+// the file into place. A nil *rawWriter discards everything, so callers
+// don't need to check whether the store is usable.
+type rawWriter struct {
+	f         *os.File
+	n         int
+	truncated bool
+}
+
+func newRawWriter() *rawWriter {
+	dir := rawStoreDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil
+	}
+	f, err := os.CreateTemp(dir, ".run-*")
+	if err != nil {
+		return nil
+	}
+	return &rawWriter{f: f}
+}
+
+func (w *rawWriter) WriteString(s string) {
+	if w == nil || w.truncated {
+		return
+	}
+	if w.n+len(s) > rawRunMaxBytes {
+		s = s[:rawRunMaxBytes-w.n]
+		w.truncated = true
+	}
+	n, _ := w.f.WriteString(s)
+	w.n += n
+	if w.truncated {
+		fmt.Fprintf(w.f, "\n[rt: output truncated at %d MiB]\n", rawRunMaxBytes>>20)
+	}
+}
+
+// commit stores the output under the run id and trims the store to its size
+// bound. It reports whether the output was stored.
+func (w *rawWriter) commit(id int64) bool {
+	if w == nil {
+		return false
+	}
+	err := w.f.Close()
+	if err == nil && id > 0 {
+		err = os.Rename(w.f.Name(), rawPath(id))
+	}
+	if err != nil || id <= 0 {
+		os.Remove(w.f.Name())
+		return false
+	}
+	pruneRawStore()
+	return true
+}
+
+// saveRaw stores output that is already in memory.
+func saveRaw(id int64, raw string) bool {
+	w := newRawWriter()
+	w.WriteString(raw)
+	return w.commit(id)
+}
+
+// saveRun stores a run's unfiltered and filtered output. It reports whether
+// the unfiltered output, the one the hidden-lines hint points at, was stored.
+func saveRun(id int64, raw, filtered string) bool {
+	if !saveRaw(id, raw) {
+		return false
+	}
+	saveFiltered(id, filtered)
+	return true
+}
+
+// saveFiltered stores what the filter printed for a run whose unfiltered
+// output is already stored, for rt last. It is best-effort.
+func saveFiltered(id int64, filtered string) {
+	if len(filtered) > rawRunMaxBytes {
+		filtered = filtered[:rawRunMaxBytes]
+	}
+	os.WriteFile(filteredPath(id), []byte(filtered), 0o600)
+}
+
+var rawFileRe = regexp.MustCompile(`^(\d+)\.log$`)
+
+// storedRunIDs returns the ids of the runs in the store, oldest first.
+func storedRunIDs() []int64 {
+	entries, _ := os.ReadDir(rawStoreDir())
+	var ids []int64
+	for _, e := range entries {
+		if m := rawFileRe.FindStringSubmatch(e.Name()); m != nil {
+			id, _ := strconv.ParseInt(m[1], 10, 64)
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// pruneRawStore removes the oldest runs until the store fits in
+// rawStoreMaxBytes, plus temporary files left behind by crashed runs.
+func pruneRawStore() {
+	dir := rawStoreDir()
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".run-") {
+			continue
+		}
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > 24*time.Hour {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+
+	ids := storedRunIDs()
+	sizes := make([]int64, len(ids))
+	var total int64
+	for i, id := range ids {
+		for _, path := range []string{rawPath(id), filteredPath(id)} {
+			if info, err := os.Stat(path); err == nil {
+				sizes[i] += info.Size()
+			}
+		}
+		total += sizes[i]
+	}
+	for i := 0; i < len(ids)-1 && total > rawStoreMaxBytes; i++ {
+		os.Remove(rawPath(ids[i]))
+		os.Remove(filteredPath(ids[i]))
+		total -= sizes[i]
+	}
+}
+
+// countShownLines counts the output lines that carry content, leaving out
+// keep_context separators and token budget markers.
+func countShownLines(output string) int {
+	return countContent(splitLines(output))
+}
+
+func countContent(lines []string) int {
+	n := 0
+	for _, line := range lines {
+		if carriesContent(line) {
+			n++
+		}
+	}
+	return n
+}
+
+func carriesContent(line string) bool {
+	return line != keepSeparator && !isOmittedMarker(line)
+}
+
+// hiddenHint returns the line appended to filtered output that omits lines,
+// pointing at the stored raw output, or "" when nothing was hidden. id is 0
+// when the raw output couldn't be stored.
+func hiddenHint(rawLines, shownLines int, id int64) string {
+	hidden := rawLines - shownLines
+	if hidden <= 0 {
+		return ""
+	}
+	if id == 0 {
+		return fmt.Sprintf("[rt: %s hidden]", plural(hidden, "line"))
+	}
+	return fmt.Sprintf("[rt: %s hidden, `rt raw %d`]", plural(hidden, "line"), id)
+}
+
+// rawQuery selects what rt last / rt raw print from a stored run.
+type rawQuery struct {
+	grep     *regexp.Regexp
+	from, to int // 1-based, inclusive; 0 means open-ended
+}
+
+// parseRawQuery consumes --grep and --lines from args and returns the rest.
+func parseRawQuery(args []string) (rawQuery, []string, error) {
+	var q rawQuery
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+		if name != "--grep" && name != "--lines" {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return q, nil, fmt.Errorf("%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		switch name {
+		case "--grep":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return q, nil, fmt.Errorf("invalid --grep: %v", err)
+			}
+			q.grep = re
+		case "--lines":
+			from, to, err := parseLineRange(value)
+			if err != nil {
+				return q, nil, err
+			}
+			q.from, q.to = from, to
+		}
+	}
+	return q, rest, nil
+}
+
+// parseLineRange parses "a:b", "a:", ":b" or a single line number "a".
+func parseLineRange(s string) (from, to int, err error) {
+	lo, hi, isRange := strings.Cut(s, ":")
+	if !isRange {
+		hi = lo
+	}
+	parse := func(v string) (int, error) {
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid --lines %q (want a:b, 1-based)", s)
+		}
+		return n, nil
+	}
+	if from, err = parse(lo); err != nil {
+		return 0, 0, err
+	}
+	if to, err = parse(hi); err != nil {
+		return 0, 0, err
+	}
+	if from > 0 && to > 0 && from > to {
+		return 0, 0, fmt.Errorf("invalid --lines %q (start after end)", s)
+	}
+	return from, to, nil
+}
+
+// apply returns the selected part of raw. With --grep, matching lines are
+// prefixed with their line number, as in grep -n.
+func (q rawQuery) apply(raw string) string {
+	if q.grep == nil && q.from == 0 && q.to == 0 {
+		return raw
+	}
+	var b strings.Builder
+	for i, line := range splitLines(raw) {
+		n := i + 1
+		if (q.from > 0 && n < q.from) || (q.to > 0 && n > q.to) {
+			continue
+		}
+		if q.grep == nil {
+			b.WriteString(line + "\n")
+		} else if q.grep.MatchString(line) {
+			fmt.Fprintf(&b, "%d:%s\n", n, line)
+		}
+	}
+	return b.String()
+}
+
+// cmdLast prints what the filter printed for the most recent run, or with
+// --raw its unfiltered output.
+func cmdLast(args []string) {
+	q, rest, err := parseRawQuery(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rt: %v\n", err)
+		os.Exit(1)
+	}
+	raw := false
+	for _, arg := range rest {
+		if arg != "--raw" {
+			fmt.Fprintln(os.Stderr, "rt: usage: rt last [--raw] [--grep <re>] [--lines a:b]")
+			os.Exit(1)
+		}
+		raw = true
+	}
+
+	ids := storedRunIDs()
+	if len(ids) == 0 {
+		fmt.Fprintln(os.Stderr, "rt: no stored output yet")
+		os.Exit(1)
+	}
+	id := ids[len(ids)-1]
+	if raw {
+		printRaw(id, q, true)
+		return
+	}
+	data, err := os.ReadFile(filteredPath(id))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rt: no filtered output stored for run %d; rt last --raw shows its unfiltered output\n", id)
+		os.Exit(1)
+	}
+	printRunHeader(id)
+	printStored(string(data), q)
+}
+
+// cmdRaw prints the stored output of a run by id.
+func cmdRaw(args []string) {
+	q, rest, err := parseRawQuery(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rt: %v\n", err)
+		os.Exit(1)
+	}
+	if len(rest) != 1 {
+		fmt.Fprintln(os.Stderr, "rt: usage: rt raw <id> [--grep <re>] [--lines a:b]")
+		os.Exit(1)
+	}
+	id, err := strconv.ParseInt(rest[0], 10, 64)
+	if err != nil || id <= 0 {
+		fmt.Fprintf(os.Stderr, "rt: invalid run id %q\n", rest[0])
+		os.Exit(1)
+	}
+	printRaw(id, q, false)
+}
+
+func printRaw(id int64, q rawQuery, header bool) {
+	data, err := os.ReadFile(rawPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "rt: no stored output for run %d (it may have been rotated out)\n", id)
+		} else {
+			fmt.Fprintf(os.Stderr, "rt: %v\n", err)
+		}
+		os.Exit(1)
+	}
+
+	if header {
+		printRunHeader(id)
+	}
+	printStored(string(data), q)
+}
+
+// printRunHeader prints the line rt last starts with: id, command, filter
+// and time of the run.
+func printRunHeader(id int64) {
+	if info, err := queryRun(id); err == nil {
+		fmt.Printf("# run %d: %s [%s] %s\n", id, info.Command, info.Filter, info.CreatedAt)
+	} else {
+		fmt.Printf("# run %d\n", id)
+	}
+}
+
+func printStored(data string, q rawQuery) {
+	out := q.apply(data)
+	fmt.Print(out)
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		fmt.Println()
+	}
+}
@@ -1,74 +1,310 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // runResult holds the output and exit code of a command execution.
 type runResult struct {
-	Output   string
+	Output   string // stdout and stderr interleaved, line by line
+	Stdout   string
+	Stderr   string
 	ExitCode int
+	TimedOut bool      // killed after the timeout; ExitCode is timeoutExitCode
+	Started  time.Time // zero for output that didn't come from a run
+	Duration time.Duration
+
+	// stderrLines marks which lines of Output came from stderr. nil means
+	// the origin is unknown and every line counts as stdout.
+	stderrLines []bool
 }
 
-// runCommand executes a command string via sh -c to support quoting and special characters.
-func runCommand(cmdStr string) runResult {
-	if cmdStr == "" {
-		return runResult{Output: "", ExitCode: 1}
-	}
+// textResult wraps output that didn't come from running a command (a file,
+// stdin, a fixture). All of it is treated as stdout.
+func textResult(raw string, exitCode int) runResult {
+	return runResult{Output: raw, Stdout: raw, ExitCode: exitCode}
+}
+
+const (
+	// timeoutExitCode is reported for commands killed by a timeout, as with
+	// coreutils timeout(1).
+	timeoutExitCode = 124
+	// killGrace is how long a timed-out command gets between SIGTERM and SIGKILL.
+	killGrace = 2 * time.Second
+)
 
+// shellCommand builds a command that runs cmdStr via sh -c to support quoting and special characters.
+func shellCommand(cmdStr string) *exec.Cmd {
 	cmd := exec.Command("sh", "-c", cmdStr)
 	cmd.Env = os.Environ()
 	cmd.Stdin = os.Stdin
+	return cmd
+}
+
+// argsCommand builds a command from args directly without shell interpolation.
+// This preserves arguments that contain shell metacharacters like (, ), |, etc.
+func argsCommand(args []string) *exec.Cmd {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = os.Stdin
+	return cmd
+}
 
+// execute runs cmd to completion and captures its output.
+//
+// With split set, stdout and stderr are captured separately and also
+// interleaved line by line. Two pipes can't preserve the exact order in which
+// the child wrote to them, so otherwise both share one pipe, which keeps the
+// order exact but loses each line's stream of origin.
+func execute(cmd *exec.Cmd, timeout time.Duration, split bool) runResult {
+	var iv interleaver
 	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	cmd.Stderr = &buf
+	if split {
+		cmd.Stdout = iv.writer(false)
+		cmd.Stderr = iv.writer(true)
+	} else {
+		cmd.Stdout = &buf
+		cmd.Stderr = &buf
+	}
 
-	err := cmd.Run()
-	exitCode := 0
+	start := time.Now()
+	wait, err := supervise(cmd, timeout)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-		} else {
-			exitCode = 1
+		return textResult(err.Error()+"\n", exitCodeOf(err))
+	}
+	exitCode, timedOut := wait()
+	duration := time.Since(start)
+
+	res := textResult(buf.String(), exitCode)
+	if split {
+		res = iv.result()
+		res.ExitCode = exitCode
+	}
+	res.TimedOut = timedOut
+	res.Started = start
+	res.Duration = duration
+	return res
+}
+
+// interleaver collects a command's stdout and stderr. Each stream is kept
+// whole, and complete lines from both are merged in arrival order so a line
+// from one stream never splits a line from the other.
+type interleaver struct {
+	mu          sync.Mutex
+	combined    strings.Builder
+	stderrLines []bool
+	streams     [2]bytes.Buffer // 0 = stdout, 1 = stderr
+	partial     [2][]byte
+}
+
+type interleaverStream struct {
+	iv  *interleaver
+	idx int
+}
+
+func (iv *interleaver) writer(stderr bool) io.Writer {
+	idx := 0
+	if stderr {
+		idx = 1
+	}
+	return interleaverStream{iv, idx}
+}
+
+func (w interleaverStream) Write(p []byte) (int, error) {
+	iv := w.iv
+	iv.mu.Lock()
+	defer iv.mu.Unlock()
+
+	iv.streams[w.idx].Write(p)
+	buf := append(iv.partial[w.idx], p...)
+	for {
+		nl := bytes.IndexByte(buf, '\n')
+		if nl < 0 {
+			break
 		}
+		iv.combined.Write(buf[:nl+1])
+		iv.stderrLines = append(iv.stderrLines, w.idx == 1)
+		buf = buf[nl+1:]
 	}
+	iv.partial[w.idx] = append([]byte(nil), buf...)
+	return len(p), nil
+}
+
+// result flushes unterminated lines and returns the captured output.
+func (iv *interleaver) result() runResult {
+	iv.mu.Lock()
+	defer iv.mu.Unlock()
 
+	for idx := range iv.partial {
+		if len(iv.partial[idx]) == 0 {
+			continue
+		}
+		if iv.combined.Len() > 0 && !strings.HasSuffix(iv.combined.String(), "\n") {
+			iv.combined.WriteByte('\n')
+		}
+		iv.combined.Write(iv.partial[idx])
+		iv.stderrLines = append(iv.stderrLines, idx == 1)
+		iv.partial[idx] = nil
+	}
 	return runResult{
-		Output:   buf.String(),
-		ExitCode: exitCode,
+		Output:      iv.combined.String(),
+		Stdout:      iv.streams[0].String(),
+		Stderr:      iv.streams[1].String(),
+		stderrLines: iv.stderrLines,
 	}
 }
 
-// runCommandFromArgs executes command args directly without shell interpolation.
-// This preserves arguments that contain shell metacharacters like (, ), |, etc.
-func runCommandFromArgs(args []string) runResult {
-	if len(args) == 0 {
-		return runResult{Output: "", ExitCode: 1}
+// executeStreaming runs cmd and calls onLine for every line of output as
+// soon as it arrives, without the trailing newline. Calls are serialized.
+// As with execute, split reads stdout and stderr from separate pipes;
+// otherwise every line is reported as stdout. Output is not buffered; the
+// returned result only carries the exit code.
+func executeStreaming(cmd *exec.Cmd, timeout time.Duration, split bool, onLine func(line string, stderr bool)) runResult {
+	n := 1
+	if split {
+		n = 2
+	}
+	pipes := make([]*os.File, n)
+	writers := make([]*os.File, n)
+	for i := range pipes {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return runResult{ExitCode: 1}
+		}
+		pipes[i], writers[i] = pr, pw
 	}
+	cmd.Stdout = writers[0]
+	cmd.Stderr = writers[n-1]
 
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Env = os.Environ()
-	cmd.Stdin = os.Stdin
+	start := time.Now()
+	wait, err := supervise(cmd, timeout)
+	// The child holds its own copies; close ours so reads end at child exit.
+	for _, pw := range writers {
+		pw.Close()
+	}
+	if err != nil {
+		for _, pr := range pipes {
+			pr.Close()
+		}
+		onLine(err.Error(), true)
+		return runResult{ExitCode: exitCodeOf(err)}
+	}
 
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	cmd.Stderr = &buf
+	var mu sync.Mutex
+	var readers sync.WaitGroup
+	for i, pr := range pipes {
+		readers.Add(1)
+		go func(pr *os.File, stderr bool) {
+			defer readers.Done()
+			defer pr.Close()
+			r := bufio.NewReader(pr)
+			for {
+				line, err := r.ReadString('\n')
+				if line != "" {
+					mu.Lock()
+					onLine(strings.TrimSuffix(line, "\n"), stderr)
+					mu.Unlock()
+				}
+				if err != nil {
+					if err != io.EOF {
+						mu.Lock()
+						onLine("rt: read error: "+err.Error(), true)
+						mu.Unlock()
+					}
+					return
+				}
+			}
+		}(pr, i == 1)
+	}
 
-	err := cmd.Run()
-	exitCode := 0
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-		} else {
-			exitCode = 1
+	exitCode, timedOut := wait()
+	readers.Wait()
+	return runResult{ExitCode: exitCode, TimedOut: timedOut, Started: start, Duration: time.Since(start)}
+}
+
+// supervise starts cmd in its own process group (see setProcessGroup) and
+// returns a function that waits for it. While waiting, termination signals
+// sent to rt are forwarded to the child's group, and once timeout elapses
+// (0 means no limit) the group gets SIGTERM, then SIGKILL after killGrace.
+func supervise(cmd *exec.Cmd, timeout time.Duration) (wait func() (exitCode int, timedOut bool), err error) {
+	restore := setProcessGroup(cmd)
+	// Once the command has exited (or been killed), stop waiting for output
+	// from processes it left behind holding the pipes
+	cmd.WaitDelay = killGrace
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardedSignals...)
+	if err := cmd.Start(); err != nil {
+		restore()
+		signal.Stop(sigs)
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	wait = func() (int, bool) {
+		defer signal.Stop(sigs)
+
+		var expired <-chan time.Time
+		if timeout > 0 {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			expired = t.C
+		}
+
+		timedOut := false
+		for {
+			select {
+			case err := <-done:
+				restore()
+				if timedOut {
+					return timeoutExitCode, true
+				}
+				return exitCodeOf(err), false
+			case sig := <-sigs:
+				forwardSignal(cmd, sig)
+			case <-expired:
+				timedOut = true
+				expired = nil
+				terminate(cmd)
+				kill := time.AfterFunc(killGrace, func() { forwardSignal(cmd, os.Kill) })
+				defer kill.Stop()
+			}
 		}
 	}
+	return wait, nil
+}
 
-	return runResult{
-		Output:   buf.String(),
-		ExitCode: exitCode,
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
 	}
+	return 1
+}
+
+// parseTimeout parses a --timeout value: a Go duration ("90s", "5m") or a
+// plain number of seconds ("30").
+func parseTimeout(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// formatTimeout renders a timeout in seconds, e.g. "30s" or "0.5s".
+func formatTimeout(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// compiledSection is a [[section]] with its regexes compiled.
+type compiledSection struct {
+	*Section
+	start, end *regexp.Regexp
+	skip, keep []*regexp.Regexp
+	replace    []compiledReplace
+}
+
+func compileSections(sections []Section) []compiledSection {
+	compiled := make([]compiledSection, 0, len(sections))
+	for i := range sections {
+		s := &sections[i]
+		start, err := compileRegex(s.Start)
+		if err != nil || s.Start == "" {
+			continue
+		}
+		cs := compiledSection{
+			Section: s,
+			start:   start,
+			skip:    compilePatterns(s.Skip),
+			keep:    compilePatterns(s.Keep),
+			replace: compileReplaceRules(s.Replace),
+		}
+		if s.End != "" {
+			if end, err := compileRegex(s.End); err == nil {
+				cs.end = end
+			}
+		}
+		compiled = append(compiled, cs)
+	}
+	return compiled
+}
+
+// sectionRunner applies [[section]] rules. A section starts at a line
+// matching its start regex and runs until its end regex matches (that line
+// included), the next line that starts any section, or the end of the
+// output. Lines outside sections pass through.
+type sectionRunner struct {
+	rules []compiledSection
+
+	cur     *compiledSection // nil when outside a section
+	window  *keepWindow
+	emitted int      // body lines emitted so far (for head)
+	tail    []string // body lines held back for tail
+	dropped int      // body lines cut by head/tail
+}
+
+func newSectionRunner(sections []Section) *sectionRunner {
+	return &sectionRunner{rules: compileSections(sections)}
+}
+
+// push feeds the next line and returns the lines to emit now.
+func (r *sectionRunner) push(line string) []string {
+	if len(r.rules) == 0 || line == keepSeparator {
+		return []string{line}
+	}
+
+	for i := range r.rules {
+		if r.rules[i].start.MatchString(line) {
+			out := r.flush()
+			r.open(&r.rules[i])
+			// The start line heads the section and is always kept
+			return append(out, replaceLine(r.cur.replace, line))
+		}
+	}
+
+	if r.cur == nil {
+		return []string{line}
+	}
+	out := r.body(line)
+	if r.cur.end != nil && r.cur.end.MatchString(line) {
+		out = append(out, r.flush()...)
+	}
+	return out
+}
+
+func (r *sectionRunner) open(s *compiledSection) {
+	r.cur = s
+	r.window = newKeepWindow(s.KeepContext)
+	r.emitted = 0
+	r.tail = nil
+	r.dropped = 0
+}
+
+// body runs a line inside the current section through its rules.
+func (r *sectionRunner) body(line string) []string {
+	s := r.cur
+	if matchesAny(s.skip, line) {
+		return nil
+	}
+	lines := []string{line}
+	if len(s.keep) > 0 {
+		lines = r.window.push(line, matchesAny(s.keep, line))
+	}
+
+	var out []string
+	for _, l := range lines {
+		if l != keepSeparator {
+			l = replaceLine(s.replace, l)
+		}
+		switch {
+		case s.Head <= 0 && s.Tail <= 0:
+			out = append(out, l)
+		case s.Head > 0 && r.emitted < s.Head:
+			out = append(out, l)
+			r.emitted++
+		case s.Tail > 0:
+			if len(r.tail) == s.Tail {
+				r.dropped++
+			}
+			r.tail = appendBounded(r.tail, l, s.Tail)
+		default:
+			r.dropped++
+		}
+	}
+	return out
+}
+
+// flush closes the current section, returning its held tail lines and a
+// marker for the lines cut by head/tail.
+func (r *sectionRunner) flush() []string {
+	if r.cur == nil {
+		return nil
+	}
+	var out []string
+	if r.dropped > 0 {
+		out = append(out, fmt.Sprintf("… %s omitted …", plural(r.dropped, "line")))
+	}
+	out = append(out, r.tail...)
+	r.cur = nil
+	r.tail = nil
+	return out
+}
+
+// applySections runs [[section]] rules over the whole output.
+func applySections(lines []string, sections []Section) []string {
+	r := newSectionRunner(sections)
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		out = append(out, r.push(line)...)
+	}
+	return append(out, r.flush()...)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// StackTraceBlock is the [stacktrace] section: it shortens Go, Python, Node,
+// Java and Rust stack traces to their project frames.
+type StackTraceBlock struct {
+	Frames  int      `toml:"frames"`  // project frames kept per trace (default 5)
+	Library []string `toml:"library"` // extra regexes for frame locations that count as library code
+}
+
+const (
+	defaultTraceFrames = 5
+	// maxTraceFrames bounds how many frames are held before a trace is
+	// rendered, so unbounded recursion doesn't hold all of its output.
+	maxTraceFrames = 2000
+)
+
+type traceLang int
+
+const (
+	traceNone traceLang = iota
+	traceGo
+	tracePython
+	traceNode
+	traceJava
+	traceRust
+)
+
+var (
+	// Go: "main.run(...)" or "created by main.main in goroutine 1", then
+	// "\t/path/to/file.go:12 +0x1d"
+	goFuncRe     = regexp.MustCompile(`^(created by \S+( in goroutine \d+)?|\S+\(.*\))$`)
+	goLocationRe = regexp.MustCompile(`^\t(.+\.go):\d+`)
+	// Python: `  File "/path/x.py", line 12, in run` and pytest's
+	// "src/x.py:12: in run"
+	pythonFileRe   = regexp.MustCompile(`^(\s*)File "([^"]+)", line \d+`)
+	pythonPytestRe = regexp.MustCompile(`^()(\S+\.py):\d+: in \S+`)
+	// Java: "\tat com.acme.App.run(App.java:12)"
+	javaFrameRe = regexp.MustCompile(`^(\s+)at ([\w$.<>/]+)\((?:[\w$]+\.(?:java|kt|scala|groovy):\d+|Native Method|Unknown Source)\)$`)
+	// Node: "    at fn (/path/x.js:1:2)", "    at /path/x.js:1:2"
+	nodeFrameRe = regexp.MustCompile(`^(\s+)at (?:\S.*? \((\S+:\d+(?::\d+)?|<anonymous>|native)\)|(?:async )?(\S+:\d+(?::\d+)?))$`)
+	// Rust (RUST_BACKTRACE): "   2: app::main", then "             at ./src/main.rs:4:5"
+	rustFrameRe    = regexp.MustCompile(`^(\s*)\d+: (\S.*)$`)
+	rustLocationRe = regexp.MustCompile(`^\s+at (.+?):\d+(:\d+)?$`)
+)
+
+// libraryMarkers are location fragments of dependency, stdlib and runtime
+// code.
+var libraryMarkers = []string{
+	"node_modules/", "node:", "<anonymous>",
+	"site-packages/", "dist-packages/", "<frozen ", "/lib/python",
+	"vendor/", "/go/pkg/mod/", "/usr/local/go/src/", "/libexec/src/",
+	"/.cargo/registry/", "/.rustup/", "/rustc/",
+	"/usr/lib/", "/usr/local/lib/",
+}
+
+var javaLibraryPrefixes = []string{
+	"java.", "javax.", "jdk.", "sun.", "com.sun.", "kotlin.", "kotlinx.", "scala.",
+	"org.junit.", "junit.", "org.gradle.", "org.apache.maven.", "org.springframework.",
+}
+
+var rustLibraryPrefixes = []string{"std::", "core::", "alloc::", "rust_begin_unwind", "__rust", "test::"}
+
+type traceFrame struct {
+	lines   []string
+	library bool
+	indent  int // for Python, continuation lines are indented deeper
+}
+
+// stackRunner shortens stack traces. Consecutive frames form a trace; any
+// other line (the error message, "Caused by:", a blank line) ends it.
+// For each trace it keeps the first Frames project frames, or the last ones
+// for Python, which prints the innermost call last. Runs of dropped frames
+// become one "… N library frames" (or "… N more frames") line.
+type stackRunner struct {
+	keep    int
+	library []*regexp.Regexp
+	cwd     string
+
+	lang    traceLang
+	frames  []traceFrame
+	held    string // a Go function line waiting for its location line
+	holding bool
+}
+
+func newStackRunner(block *StackTraceBlock) *stackRunner {
+	r := &stackRunner{keep: defaultTraceFrames}
+	if block == nil {
+		return r
+	}
+	if block.Frames > 0 {
+		r.keep = block.Frames
+	}
+	r.library = compilePatterns(block.Library)
+	r.cwd = outputDir()
+	return r
+}
+
+// push feeds the next line and returns the lines to emit now.
+func (r *stackRunner) push(line string) []string {
+	if r.holding {
+		fn := r.held
+		r.holding = false
+		if m := goLocationRe.FindStringSubmatch(line); m != nil {
+			return r.addFrame(traceGo, traceFrame{
+				lines:   []string{fn, line},
+				library: r.isLibraryPath(m[1]),
+			})
+		}
+		// Not a Go frame after all: it ends the trace
+		out := append(r.flush(), fn)
+		return append(out, r.push(line)...)
+	}
+
+	if r.continues(line) {
+		last := &r.frames[len(r.frames)-1]
+		last.lines = append(last.lines, line)
+		return nil
+	}
+	if lang, frame, ok := r.parseFrame(line); ok {
+		return r.addFrame(lang, frame)
+	}
+	if goFuncRe.MatchString(line) && strings.Contains(line, ".") {
+		var out []string
+		if r.lang != traceGo {
+			out = r.flush()
+		}
+		r.held, r.holding = line, true
+		return out
+	}
+	return append(r.flush(), line)
+}
+
+// continues reports whether line belongs to the last frame: Python source
+// and caret lines, Rust "at" lines.
+func (r *stackRunner) continues(line string) bool {
+	if len(r.frames) == 0 {
+		return false
+	}
+	last := r.frames[len(r.frames)-1]
+	switch r.lang {
+	case tracePython:
+		if pythonFileRe.MatchString(line) || strings.TrimSpace(line) == "" {
+			return false
+		}
+		return leadingSpaces(line) > last.indent
+	case traceRust:
+		if m := rustLocationRe.FindStringSubmatch(line); m != nil && len(last.lines) == 1 {
+			r.frames[len(r.frames)-1].library = r.isLibraryPath(m[1])
+			return true
+		}
+	}
+	return false
+}
+
+func (r *stackRunner) parseFrame(line string) (traceLang, traceFrame, bool) {
+	frame := traceFrame{lines: []string{line}}
+	if m := pythonFileRe.FindStringSubmatch(line); m != nil {
+		frame.indent = len(m[1])
+		frame.library = r.isLibraryPath(m[2])
+		return tracePython, frame, true
+	}
+	if m := pythonPytestRe.FindStringSubmatch(line); m != nil {
+		frame.library = r.isLibraryPath(m[2])
+		return tracePython, frame, true
+	}
+	if m := javaFrameRe.FindStringSubmatch(line); m != nil {
+		frame.library = hasAnyPrefix(m[2], javaLibraryPrefixes) ||
+			strings.HasSuffix(line, "(Native Method)") || strings.HasSuffix(line, "(Unknown Source)")
+		return traceJava, frame, true
+	}
+	if m := nodeFrameRe.FindStringSubmatch(line); m != nil {
+		location := m[2]
+		if location == "" {
+			location = m[3]
+		}
+		// Node before 16 names its own modules "internal/..." with no path
+		frame.library = strings.HasPrefix(location, "internal/") || r.isLibraryPath(location)
+		return traceNode, frame, true
+	}
+	if m := rustFrameRe.FindStringSubmatch(line); m != nil && (r.lang == traceRust || strings.Contains(m[2], "::") || hasAnyPrefix(m[2], rustLibraryPrefixes)) {
+		// Without an "at" line, only the symbol tells library code apart
+		frame.library = hasAnyPrefix(m[2], rustLibraryPrefixes)
+		return traceRust, frame, true
+	}
+	return traceNone, frame, false
+}
+
+func (r *stackRunner) addFrame(lang traceLang, frame traceFrame) []string {
+	var out []string
+	if lang != r.lang || len(r.frames) >= maxTraceFrames {
+		out = r.flush()
+	}
+	r.lang = lang
+	r.frames = append(r.frames, frame)
+	return out
+}
+
+// isLibraryPath reports whether a frame location is outside the project:
+// dependency, stdlib or runtime code, or an absolute path outside the
+// working directory.
+func (r *stackRunner) isLibraryPath(path string) bool {
+	path = strings.TrimPrefix(path, "file://")
+	for _, marker := range libraryMarkers {
+		if strings.Contains(path, marker) {
+			return true
+		}
+	}
+	if matchesAny(r.library, path) {
+		return true
+	}
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(r.cwd, path)
+	return r.cwd == "" || err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// flush renders the current trace and any held Go function line.
+func (r *stackRunner) flush() []string {
+	var out []string
+	if len(r.frames) > 0 {
+		out = r.render()
+		r.frames = nil
+		r.lang = traceNone
+	}
+	if r.holding {
+		r.holding = false
+		out = append(out, r.held)
+	}
+	return out
+}
+
+func (r *stackRunner) render() []string {
+	kept := make([]bool, len(r.frames))
+	n := 0
+	for i := range r.frames {
+		// Python lists the innermost call last
+		j := i
+		if r.lang == tracePython {
+			j = len(r.frames) - 1 - i
+		}
+		if !r.frames[j].library && n < r.keep {
+			kept[j] = true
+			n++
+		}
+	}
+
+	var out []string
+	for i := 0; i < len(r.frames); {
+		if kept[i] {
+			out = append(out, r.frames[i].lines...)
+			i++
+			continue
+		}
+		start, library := i, true
+		for ; i < len(r.frames) && !kept[i]; i++ {
+			library = library && r.frames[i].library
+		}
+		first := r.frames[start].lines[0]
+		indent := first[:len(first)-len(strings.TrimLeft(first, " \t"))]
+		out = append(out, indent+droppedFrames(i-start, library))
+	}
+	return out
+}
+
+func droppedFrames(n int, library bool) string {
+	kind := "more"
+	if library {
+		kind = "library"
+	}
+	return fmt.Sprintf("… %s", plural(n, kind+" frame"))
+}
+
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyStackTrace shortens the stack traces in the whole output.
+func applyStackTrace(block *StackTraceBlock, lines []string) []string {
+	r := newStackRunner(block)
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		out = append(out, r.push(line)...)
+	}
+	return append(out, r.flush()...)
+}
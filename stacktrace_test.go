@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStackTraceProjectInternal(t *testing.T) {
+	old := workDir
+	workDir = "/tmp/proj"
+	t.Cleanup(func() { workDir = old })
+
+	in := []string{
+		"panic: boom",
+		"",
+		"goroutine 1 [running]:",
+		"database/sql.(*DB).QueryRowContext(...)",
+		"\t/usr/local/go/src/database/sql/sql.go:1958",
+		"acme/proj/internal/db.(*Store).Get(...)",
+		"\t/tmp/proj/internal/db/db.go:42 +0x1d",
+		"acme/proj/internal/api.handle(...)",
+		"\t/tmp/proj/internal/api/api.go:17 +0x2b",
+		"main.main()",
+		"\t/tmp/proj/main.go:9 +0x25",
+	}
+	got := strings.Join(applyStackTrace(&StackTraceBlock{}, in), "\n")
+	want := strings.Join([]string{
+		"panic: boom",
+		"",
+		"goroutine 1 [running]:",
+		"… 1 library frame",
+		"acme/proj/internal/db.(*Store).Get(...)",
+		"\t/tmp/proj/internal/db/db.go:42 +0x1d",
+		"acme/proj/internal/api.handle(...)",
+		"\t/tmp/proj/internal/api/api.go:17 +0x2b",
+		"main.main()",
+		"\t/tmp/proj/main.go:9 +0x25",
+	}, "\n")
+	if got != want {
+		t.Errorf("applyStackTrace:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStackTraceNodeInternal(t *testing.T) {
+	in := []string{
+		"TypeError: x is not a function",
+		"    at run (src/app.js:3:5)",
+		"    at Module._compile (internal/modules/cjs/loader.js:1085:14)",
+		"    at node:internal/main/run_main_module:22:47",
+	}
+	got := strings.Join(applyStackTrace(&StackTraceBlock{}, in), "\n")
+	want := strings.Join([]string{
+		"TypeError: x is not a function",
+		"    at run (src/app.js:3:5)",
+		"    … 2 library frames",
+	}, "\n")
+	if got != want {
+		t.Errorf("applyStackTrace:\n%s\nwant:\n%s", got, want)
+	}
+}
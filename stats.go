@@ -70,20 +70,50 @@ func estimateTokens(s string) int {
 	return (len(s) + 3) / 4
 }
 
-func recordRun(filterName, command, rawOutput, filteredOutput string) {
+// recordRun records a run and returns its id, or 0 if it couldn't be recorded.
+func recordRun(filterName, command, rawOutput, filteredOutput string) int64 {
+	return recordRunTokens(filterName, command, estimateTokens(rawOutput), estimateTokens(filteredOutput))
+}
+
+// recordRunTokens records a run whose token counts are already known, e.g.
+// when streaming output that was never held in memory as a whole.
+func recordRunTokens(filterName, command string, inputTok, outputTok int) int64 {
 	db, err := openStatsDB()
 	if err != nil {
-		return // stats are best-effort
+		return 0 // stats are best-effort
 	}
 	defer db.Close()
 
-	inputTok := estimateTokens(rawOutput)
-	outputTok := estimateTokens(filteredOutput)
-
-	_, _ = db.Exec(
+	res, err := db.Exec(
 		`INSERT INTO runs (filter_name, command, input_tokens, output_tokens, created_at) VALUES (?, ?, ?, ?, ?)`,
 		filterName, command, inputTok, outputTok, time.Now().UTC().Format(time.RFC3339),
 	)
+	if err != nil {
+		return 0
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// runInfo is a row of the runs table.
+type runInfo struct {
+	ID        int64
+	Filter    string
+	Command   string
+	CreatedAt string
+}
+
+func queryRun(id int64) (runInfo, error) {
+	db, err := openStatsDB()
+	if err != nil {
+		return runInfo{}, err
+	}
+	defer db.Close()
+
+	r := runInfo{ID: id}
+	err = db.QueryRow(`SELECT filter_name, command, created_at FROM runs WHERE id = ?`, id).
+		Scan(&r.Filter, &r.Command, &r.CreatedAt)
+	return r, err
 }
 
 type gainEntry struct {
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// streamRingLines bounds how many filtered lines stream mode keeps for the
+	// exit-code branch, which can only run once the command has exited.
+	streamRingLines = 200
+	// streamTailBytes bounds how much unfiltered output stream mode keeps for
+	// match_output.
+	streamTailBytes = 256 << 10
+	// streamSeenMax bounds the keys remembered for dedupe / collapse; past it
+	// the set starts over.
+	streamSeenMax = 10000
+)
+
+// lineStream applies a filter incrementally, one line at a time.
+//
+// Per-line steps (strip_ansi, skip, keep, replace) run as lines arrive.
+// Whole-output steps are deferred to Finish and only see bounded buffers:
+// match_output gets the last streamTailBytes of output and the exit-code
+// branch gets the last streamRingLines filtered lines. collapse and dedupe
+// can't count lines that were already printed, so they only drop repeats.
+type lineStream struct {
+	f        *Filter
+	streams  streamRules
+	skip     []*regexp.Regexp
+	keep     []*regexp.Regexp
+	window   *keepWindow
+	stages   []lineRunner // stacktrace, diagnostics and diff, when set
+	sections *sectionRunner
+	table    *tableRunner
+	replace  []compiledReplace
+	collapse []compiledReplace
+	seen     map[string]bool
+	counts   *counters
+	tests    *testReporter
+
+	// Token budget: once printed output reaches budget, only important
+	// lines are printed and the rest are counted for the final marker.
+	budget       int
+	important    []*regexp.Regexp
+	omitted      int
+	omittedToken int
+
+	ring     []string
+	ringSize int
+	tail     []byte
+	text     streamText // last lines per stream, for {stdout} / {stderr}
+
+	linesTotal int // raw lines seen, for {lines_total}
+	linesShown int // content lines printed, for {lines_omitted}
+
+	InputTokens  int
+	OutputTokens int
+}
+
+// lineRunner is a step that takes the output one line at a time, so the
+// same code serves buffered and stream mode. It may hold lines back while
+// it reads a larger unit (a stack trace, a diagnostic, a diff file) and
+// emit them later, from push or, once the output has ended, from flush.
+type lineRunner interface {
+	push(line string) []string
+	flush() []string
+}
+
+// lineRunners returns the stages that run before skip in stream mode, in
+// pipeline order.
+func lineRunners(f *Filter) []lineRunner {
+	var stages []lineRunner
+	if f.StackTrace != nil {
+		stages = append(stages, newStackRunner(f.StackTrace))
+	}
+	if f.Diagnostics.Enabled {
+		stages = append(stages, newDiagnosticsRunner(f.Diagnostics))
+	}
+	if f.Diff != nil {
+		stages = append(stages, newDiffRunner(f.Diff))
+	}
+	return stages
+}
+
+func newLineStream(f *Filter) *lineStream {
+	ringSize := streamRingLines
+	for _, b := range []*OutputBlock{f.OnSuccess, f.OnFailure} {
+		if b != nil && b.Tail > ringSize {
+			ringSize = b.Tail
+		}
+	}
+	return &lineStream{
+		f:         f,
+		streams:   compileStreamRules(f),
+		skip:      compilePatterns(f.Skip),
+		keep:      compilePatterns(f.Keep),
+		window:    newKeepWindow(f.KeepContext),
+		stages:    lineRunners(f),
+		sections:  newSectionRunner(f.Sections),
+		table:     newTableRunner(f.Table, true),
+		replace:   compileReplaceRules(f.Replace),
+		collapse:  compileReplaceRules(f.Collapse),
+		seen:      make(map[string]bool),
+		counts:    newCounters(f.Count),
+		tests:     newTestReporter(f),
+		budget:    f.MaxTokens,
+		important: compilePatterns(importantPatterns(f)),
+		ringSize:  ringSize,
+	}
+}
+
+// Line runs one raw line through the per-line steps and returns the lines
+// to print: none when it is dropped, more than one when it is a keep match
+// that releases held keep_context lines.
+func (s *lineStream) Line(raw string, stderr bool) []string {
+	s.InputTokens += estimateTokens(raw + "\n")
+	s.linesTotal++
+
+	line := raw
+	if s.f.StripAnsi {
+		line = stripAnsi(line)
+	}
+	s.appendTail(line)
+
+	kept, selected := s.streams.admit(line, stderr)
+	if kept {
+		if stderr {
+			s.text.Stderr = appendBounded(s.text.Stderr, line, s.ringSize)
+		} else {
+			s.text.Stdout = appendBounded(s.text.Stdout, line, s.ringSize)
+		}
+	}
+	if !selected {
+		return nil
+	}
+	s.counts.add(line)
+	s.tests.push(line)
+
+	return s.pipe([]string{line}, 0)
+}
+
+// pipe runs lines through the stages from index from on, then through the
+// steps from skip on.
+func (s *lineStream) pipe(lines []string, from int) []string {
+	if from == len(s.stages) {
+		var out []string
+		for _, line := range lines {
+			out = append(out, s.filterLine(line)...)
+		}
+		return out
+	}
+	var next []string
+	for _, line := range lines {
+		next = append(next, s.stages[from].push(line)...)
+	}
+	return s.pipe(next, from+1)
+}
+
+// filterLine runs the steps from skip on.
+func (s *lineStream) filterLine(line string) []string {
+	if len(s.skip) > 0 && matchesAny(s.skip, line) {
+		return nil
+	}
+	lines := []string{line}
+	if len(s.keep) > 0 {
+		lines = s.window.push(line, matchesAny(s.keep, line))
+	}
+	var sectioned []string
+	for _, line := range lines {
+		sectioned = append(sectioned, s.sections.push(line)...)
+	}
+	return s.emit(s.tabulate(sectioned))
+}
+
+// tabulate runs lines through the [table] step, if there is one.
+func (s *lineStream) tabulate(lines []string) []string {
+	if s.f.Table == nil {
+		return lines
+	}
+	var out []string
+	for _, line := range lines {
+		out = append(out, s.table.push(line)...)
+	}
+	return out
+}
+
+// emit runs the steps after [[section]] and returns the lines to print.
+func (s *lineStream) emit(lines []string) []string {
+	var out []string
+	for _, line := range lines {
+		if line != keepSeparator {
+			line = replaceLine(s.replace, line)
+			if s.repeated(line) {
+				continue
+			}
+		}
+		cost := estimateTokens(line + "\n")
+		if s.budget > 0 && s.OutputTokens+cost > s.budget && !matchesAny(s.important, line) {
+			s.omitted++
+			s.omittedToken += cost
+			continue
+		}
+		s.ring = appendBounded(s.ring, line, s.ringSize)
+		s.OutputTokens += cost
+		if carriesContent(line) {
+			s.linesShown++
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// repeated reports whether line collapses or dedupes into one already
+// printed.
+func (s *lineStream) repeated(line string) bool {
+	key, _, ok := collapseKey(s.collapse, line)
+	if !ok && s.f.Dedupe {
+		key, _, ok = dedupeKey(line)
+	}
+	if !ok {
+		return false
+	}
+	if s.seen[key] {
+		return true
+	}
+	if len(s.seen) >= streamSeenMax {
+		s.seen = make(map[string]bool)
+	}
+	s.seen[key] = true
+	return false
+}
+
+// appendBounded appends line, keeping at most n of the most recent lines.
+func appendBounded(lines []string, line string, n int) []string {
+	lines = append(lines, line)
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+func (s *lineStream) appendTail(line string) {
+	s.tail = append(s.tail, line...)
+	s.tail = append(s.tail, '\n')
+	if len(s.tail) > streamTailBytes {
+		s.tail = s.tail[len(s.tail)-streamTailBytes:]
+	}
+}
+
+// Finish runs the deferred steps once the exit code is known and returns the
+// text to print after the streamed lines, or "" for nothing.
+//
+// Streamed lines can't be taken back, so a matching match_output rule adds
+// its output at the end instead of replacing everything, and the exit-code
+// branch is only rendered when it selects or rewrites lines (start_at, skip,
+// keep or a custom output template). head/tail alone have nothing to do.
+// Lines held back by the token budget are reported first, as one marker.
+func (s *lineStream) Finish(res runResult) string {
+	marker := ""
+	if s.omitted > 0 {
+		marker = omittedMarker(s.omitted, s.omittedToken) + "\n"
+	}
+	return marker + s.finishBlock(res)
+}
+
+// Flush returns the lines still held once the output has ended: a stack
+// trace still being read, the collected diagnostics, the last file of a
+// diff, the tail of a [[section]] that was still open and the [table] row
+// cap marker.
+func (s *lineStream) Flush() []string {
+	var out []string
+	for i, stage := range s.stages {
+		out = append(out, s.pipe(stage.flush(), i+1)...)
+	}
+	lines := s.tabulate(s.sections.flush())
+	if s.f.Table != nil {
+		lines = append(lines, s.table.flush()...)
+	}
+	return append(out, s.emit(lines)...)
+}
+
+func (s *lineStream) finishBlock(res runResult) string {
+	if out, ok := matchOutput(s.f.MatchOutput, string(s.tail)); ok {
+		return out
+	}
+
+	block := s.f.OnSuccess
+	if res.ExitCode != 0 {
+		block = s.f.OnFailure
+	}
+	if block == nil || !block.summarizes() {
+		return ""
+	}
+	lines := append([]string(nil), s.ring...)
+	vars := summaryVars(s.counts, s.text, res.ExitCode, s.linesTotal, res.Duration)
+	// The streamed lines are already out; what was omitted is what wasn't printed
+	vars["lines_omitted"] = strconv.Itoa(s.linesTotal - s.linesShown)
+	lines, full := s.tests.apply(block, lines, strings.Join(lines, "\n"), vars, res)
+	return applyOutputBlock(block, lines, full, vars)
+}
+
+// summarizes reports whether the block does more than trim or pass through
+// lines, i.e. whether rendering it after a stream adds information.
+func (b *OutputBlock) summarizes() bool {
+	return b.StartAt != "" || len(b.Skip) > 0 || len(b.Keep) > 0 || b.TestReport != nil ||
+		(b.Output != "" && b.Output != "{output}")
+}
+
+// runStreaming executes cmd for a stream = true filter, printing filtered
+// lines as they arrive.
+func runStreaming(f *Filter, cmdStr string, cmd *exec.Cmd, timeout time.Duration) {
+	ls := newLineStream(f)
+	if ls.budget == 0 {
+		ls.budget = loadConfig().MaxTokens
+	}
+	raw := newRawWriter()
+	var shown strings.Builder // what was printed, for rt last
+	rawLines, shownLines := 0, 0
+	show := func(out string) {
+		fmt.Println(out)
+		if shown.Len() < rawRunMaxBytes {
+			shown.WriteString(out + "\n")
+		}
+		if carriesContent(out) {
+			shownLines++
+		}
+	}
+	result := executeStreaming(cmd, timeout, f.splitsStreams(), func(line string, stderr bool) {
+		raw.WriteString(line + "\n")
+		rawLines++
+		for _, out := range ls.Line(line, stderr) {
+			show(out)
+		}
+	})
+
+	for _, out := range ls.Flush() {
+		show(out)
+	}
+
+	printExitStatus(result, timeout)
+	summary := ls.Finish(result)
+	fmt.Print(summary)
+	if summary != "" && !strings.HasSuffix(summary, "\n") {
+		fmt.Println()
+	}
+
+	id := recordRunTokens(f.Name, cmdStr, ls.InputTokens, ls.OutputTokens+estimateTokens(summary))
+	if raw.commit(id) {
+		saveFiltered(id, shown.String()+summary)
+	} else {
+		id = 0
+	}
+	// The summary isn't output lines, so only the streamed ones count as shown
+	if hint := hiddenHint(rawLines, shownLines, id); hint != "" {
+		fmt.Println(hint)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestStream builds a lineStream from filter TOML.
+func newTestStream(t *testing.T, data string) *lineStream {
+	t.Helper()
+	f, problems, err := decodeFilter([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("problems: %q", problemStrings(problems))
+	}
+	return newLineStream(&f)
+}
+
+// feed pushes lines one at a time and returns what each one printed.
+func feed(s *lineStream, lines ...string) [][]string {
+	out := make([][]string, len(lines))
+	for i, line := range lines {
+		out[i] = s.Line(line, false)
+	}
+	return out
+}
+
+func TestLineStreamEmitsAsLinesArrive(t *testing.T) {
+	s := newTestStream(t, `command = "docker compose up"
+stream = true
+skip = ['^\s*Network ']
+
+[[replace]]
+pattern = '^\s*Container (\S+)\s+Started$'
+output = "started {1}"
+`)
+	got := feed(s,
+		" Network widget_default  Created",
+		" Container widget-db-1  Started",
+		"db-1  | ready to accept connections",
+	)
+	want := [][]string{
+		nil,
+		{"started widget-db-1"},
+		{"db-1  | ready to accept connections"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Line:\n got %q\nwant %q", got, want)
+	}
+	if rest := s.Flush(); len(rest) != 0 {
+		t.Errorf("Flush = %q; want nothing", rest)
+	}
+}
+
+func TestLineStreamFlushesHeldLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		toml  string
+		lines []string
+		held  int // how many of the last lines print nothing until Flush
+		flush []string
+	}{
+		{
+			name: "stack trace",
+			toml: "command = \"node app.js\"\nstream = true\n[stacktrace]\n",
+			lines: []string{
+				"TypeError: x is not a function",
+				"    at run (src/app.js:3:5)",
+				"    at Module._compile (node:internal/modules/cjs/loader:1376:14)",
+			},
+			held:  2,
+			flush: []string{"    at run (src/app.js:3:5)", "    … 1 library frame"},
+		},
+		{
+			name: "diff",
+			toml: "command = \"git diff\"\nstream = true\n[diff]\n",
+			lines: []string{
+				"diff --git a/main.go b/main.go",
+				"--- a/main.go",
+				"+++ b/main.go",
+				"@@ -1 +1 @@",
+				"-old",
+				"+new",
+			},
+			held:  6,
+			flush: []string{"=== main.go", "@@ L1", "-old", "+new"},
+		},
+		{
+			name: "open section",
+			toml: "command = \"make\"\nstream = true\n[[section]]\nstart = '^Step '\ntail = 1\n",
+			lines: []string{
+				"Step 1/2",
+				"downloading a",
+				"downloading b",
+			},
+			held:  2,
+			flush: []string{"… 1 line omitted …", "downloading b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStream(t, tt.toml)
+			got := feed(s, tt.lines...)
+			for i := len(got) - tt.held; i < len(got); i++ {
+				if len(got[i]) > 0 {
+					t.Errorf("line %q printed %q before the unit ended", tt.lines[i], got[i])
+				}
+			}
+			if flush := s.Flush(); !reflect.DeepEqual(flush, tt.flush) {
+				t.Errorf("Flush:\n got %q\nwant %q", flush, tt.flush)
+			}
+		})
+	}
+}
+
+func TestLineStreamBudgetMarker(t *testing.T) {
+	s := newTestStream(t, `command = "make"
+stream = true
+max_tokens = 6
+`)
+	var printed []string
+	for _, out := range feed(s, "compiling alpha", "compiling beta", "compiling gamma", "error: gamma failed", "compiling delta") {
+		printed = append(printed, out...)
+	}
+	printed = append(printed, s.Flush()...)
+	want := []string{"compiling alpha", "error: gamma failed"}
+	if !reflect.DeepEqual(printed, want) {
+		t.Errorf("printed:\n got %q\nwant %q", printed, want)
+	}
+	summary := s.Finish(runResult{ExitCode: 2})
+	if !strings.HasPrefix(summary, "… 3 lines / ") || !isOmittedMarker(strings.TrimSuffix(summary, "\n")) {
+		t.Errorf("Finish = %q; want the omitted marker for 3 lines", summary)
+	}
+}
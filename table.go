@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// TableBlock is the [table] section: column-aware filtering for the
+// whitespace-aligned tables printed by kubectl, docker, gh and the like.
+type TableBlock struct {
+	Header   string            `toml:"header"`    // regex for the header line (default: the first line)
+	Columns  []string          `toml:"columns"`   // names for output without a header line
+	Select   []string          `toml:"select"`    // columns to print, in this order (default: all)
+	Drop     []string          `toml:"drop"`      // columns not to print; missing ones are ignored
+	Rename   map[string]string `toml:"rename"`    // column → printed header
+	KeepRows map[string]string `toml:"keep_rows"` // column → regex; a row must match all
+	SkipRows map[string]string `toml:"skip_rows"` // column → regex; a row matching any is dropped
+	MaxRows  int               `toml:"max_rows"`  // print at most this many rows
+	Format   string            `toml:"format"`    // "aligned" (compact, default) or "tsv"
+}
+
+type rowRule struct {
+	col int
+	re  *regexp.Regexp
+}
+
+// tableRunner applies a [table] block. Lines before the header pass through.
+// The table ends at the first blank line; what follows passes through too.
+// A headerless table only pauses there, since output like ls -l with several
+// directories prints one block per directory.
+//
+// Rows are cut at the header's column offsets, so empty cells and values
+// with spaces are read correctly. Without a header (columns set), rows are
+// split on tabs if they have any, else on whitespace, with the last column
+// taking the rest of the line; lines with too few fields pass through.
+type tableRunner struct {
+	block  *TableBlock
+	stream bool // print rows as they arrive instead of aligning them at the end
+
+	header  *regexp.Regexp
+	names   []string // source column names
+	offsets []int    // rune offset where each column starts; nil without a header
+	picked  []int    // source column of each printed column
+	keep    []rowRule
+	skip    []rowRule
+
+	state   int // tableBefore, tableRows or tableAfter
+	rows    [][]string
+	printed int
+	dropped int
+}
+
+const (
+	tableBefore = iota
+	tableRows
+	tableAfter
+)
+
+func newTableRunner(block *TableBlock, stream bool) *tableRunner {
+	t := &tableRunner{block: block, stream: stream}
+	if block == nil {
+		return t
+	}
+	if block.Header != "" {
+		if re, err := compileRegex(block.Header); err == nil {
+			t.header = re
+		}
+	}
+	if len(block.Columns) > 0 {
+		// Headerless: the columns are known up front and there is no header
+		// line to print
+		if t.setColumns(block.Columns) {
+			t.state = tableRows
+		} else {
+			t.state = tableAfter
+		}
+	}
+	return t
+}
+
+// setColumns resolves select and the row rules against the column names.
+// It fails when one of them names a column the table doesn't have, which
+// means this isn't the expected table; the output is then left alone.
+func (t *tableRunner) setColumns(names []string) bool {
+	t.names = names
+	t.picked = nil
+	if len(t.block.Select) == 0 {
+		for i, name := range names {
+			if columnIndex(t.block.Drop, name) < 0 {
+				t.picked = append(t.picked, i)
+			}
+		}
+	}
+	for _, name := range t.block.Select {
+		i := columnIndex(names, name)
+		if i < 0 {
+			return false
+		}
+		t.picked = append(t.picked, i)
+	}
+	var ok bool
+	if t.keep, ok = t.rowRules(t.block.KeepRows); !ok {
+		return false
+	}
+	t.skip, ok = t.rowRules(t.block.SkipRows)
+	return ok
+}
+
+func (t *tableRunner) rowRules(rules map[string]string) ([]rowRule, bool) {
+	var out []rowRule
+	for name, pattern := range rules {
+		i := columnIndex(t.names, name)
+		if i < 0 {
+			return nil, false
+		}
+		if re, err := compileRegex(pattern); err == nil {
+			out = append(out, rowRule{i, re})
+		}
+	}
+	return out, true
+}
+
+// columnIndex finds a column by name, ignoring case.
+func columnIndex(names []string, name string) int {
+	for i, n := range names {
+		if strings.EqualFold(n, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// push feeds the next line and returns the lines to emit now.
+func (t *tableRunner) push(line string) []string {
+	if line == keepSeparator {
+		return []string{line}
+	}
+	switch t.state {
+	case tableBefore:
+		if t.header != nil && !t.header.MatchString(line) || strings.TrimSpace(line) == "" {
+			return []string{line}
+		}
+		names, offsets := parseHeader(line)
+		if !t.setColumns(names) {
+			t.state = tableAfter
+			return []string{line}
+		}
+		t.offsets = offsets
+		t.state = tableRows
+		return t.add(t.headerRow())
+	case tableRows:
+		if strings.TrimSpace(line) == "" {
+			out := t.flush()
+			if t.offsets != nil {
+				t.state = tableAfter
+			}
+			return append(out, line)
+		}
+		cells, ok := t.cells(line)
+		if !ok {
+			return []string{line}
+		}
+		if !t.wanted(cells) {
+			return nil
+		}
+		if t.block.MaxRows > 0 && t.printed >= t.block.MaxRows {
+			t.dropped++
+			return nil
+		}
+		t.printed++
+		return t.add(t.pick(cells))
+	}
+	return []string{line}
+}
+
+// add queues a row for aligned output, or renders it right away.
+func (t *tableRunner) add(row []string) []string {
+	if t.block.Format == "tsv" {
+		return []string{strings.Join(row, "\t")}
+	}
+	if t.stream {
+		return []string{t.streamRow(row)}
+	}
+	t.rows = append(t.rows, row)
+	return nil
+}
+
+// flush renders the queued rows and the marker for rows cut by max_rows.
+func (t *tableRunner) flush() []string {
+	var out []string
+	if len(t.rows) > 0 {
+		out = alignRows(t.rows)
+		t.rows = nil
+	}
+	if t.dropped > 0 {
+		out = append(out, fmt.Sprintf("… %s", plural(t.dropped, "more row")))
+		t.dropped = 0
+	}
+	return out
+}
+
+func (t *tableRunner) headerRow() []string {
+	row := make([]string, len(t.picked))
+	for i, col := range t.picked {
+		name := t.names[col]
+		for from, to := range t.block.Rename {
+			if strings.EqualFold(from, name) {
+				name = to
+			}
+		}
+		row[i] = name
+	}
+	return row
+}
+
+// cells splits a row into one cell per source column.
+func (t *tableRunner) cells(line string) ([]string, bool) {
+	if t.offsets != nil {
+		return cutColumns(line, t.offsets), true
+	}
+	var fields []string
+	if strings.Contains(line, "\t") {
+		fields = strings.SplitN(line, "\t", len(t.names))
+	} else {
+		fields = splitFieldsN(line, len(t.names))
+	}
+	if len(fields) < len(t.names) {
+		return nil, false
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields, true
+}
+
+func (t *tableRunner) wanted(cells []string) bool {
+	for _, r := range t.keep {
+		if !r.re.MatchString(cells[r.col]) {
+			return false
+		}
+	}
+	for _, r := range t.skip {
+		if r.re.MatchString(cells[r.col]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *tableRunner) pick(cells []string) []string {
+	row := make([]string, len(t.picked))
+	for i, col := range t.picked {
+		row[i] = cells[col]
+	}
+	return row
+}
+
+// streamRow aligns a row without knowing the rows to come, padding each
+// cell to the width of its source column.
+func (t *tableRunner) streamRow(row []string) string {
+	if t.offsets == nil {
+		return strings.Join(row, "  ")
+	}
+	var b strings.Builder
+	for i, cell := range row {
+		if i == len(row)-1 {
+			b.WriteString(cell)
+			break
+		}
+		col := t.picked[i]
+		width := len([]rune(t.names[col])) + 2
+		if col+1 < len(t.offsets) {
+			width = t.offsets[col+1] - t.offsets[col]
+		}
+		b.WriteString(cell)
+		b.WriteString(strings.Repeat(" ", max(width-len([]rune(cell)), 2)))
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// parseHeader returns the column names of a header line and the rune offset
+// where each starts.
+func parseHeader(line string) ([]string, []int) {
+	runes := []rune(line)
+	var names []string
+	var offsets []int
+	start := -1
+	for i := 0; i <= len(runes); i++ {
+		gap := i == len(runes) || runes[i] == '\t' ||
+			(runes[i] == ' ' && (i+1 == len(runes) || unicode.IsSpace(runes[i+1])))
+		if gap {
+			if start >= 0 {
+				names = append(names, string(runes[start:i]))
+				offsets = append(offsets, start)
+				start = -1
+			}
+			continue
+		}
+		if start < 0 && !unicode.IsSpace(runes[i]) {
+			start = i
+		}
+	}
+	return names, offsets
+}
+
+// cutColumns cuts line at the header offsets. A value that runs past its
+// column's end pushes the cut to the next space.
+func cutColumns(line string, offsets []int) []string {
+	runes := []rune(line)
+	cells := make([]string, len(offsets))
+	from := 0
+	for i := range offsets {
+		to := len(runes)
+		if i+1 < len(offsets) {
+			to = min(offsets[i+1], len(runes))
+			for to > 0 && to < len(runes) && !unicode.IsSpace(runes[to-1]) && !unicode.IsSpace(runes[to]) {
+				to++
+			}
+		}
+		if from < to {
+			cells[i] = strings.TrimSpace(string(runes[from:to]))
+		}
+		from = max(to, from)
+	}
+	return cells
+}
+
+// splitFieldsN splits s on runs of whitespace into at most n fields, the
+// last one holding the rest of the line.
+func splitFieldsN(s string, n int) []string {
+	var fields []string
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	for s != "" && len(fields) < n-1 {
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if end < 0 {
+			break
+		}
+		fields = append(fields, s[:end])
+		s = strings.TrimLeftFunc(s[end:], unicode.IsSpace)
+	}
+	if s != "" {
+		fields = append(fields, s)
+	}
+	return fields
+}
+
+// alignRows pads every column but the last to its widest cell.
+func alignRows(rows [][]string) []string {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], len([]rune(cell)))
+		}
+	}
+	out := make([]string, len(rows))
+	for r, row := range rows {
+		var b strings.Builder
+		for i, cell := range row {
+			b.WriteString(cell)
+			if i < len(row)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-len([]rune(cell))+2))
+			}
+		}
+		out[r] = strings.TrimRight(b.String(), " ")
+	}
+	return out
+}
+
+// applyTable runs a [table] block over the whole output.
+func applyTable(block *TableBlock, lines []string) []string {
+	t := newTableRunner(block, false)
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		out = append(out, t.push(line)...)
+	}
+	return append(out, t.flush()...)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTableHeaderlessBlocks(t *testing.T) {
+	block := &TableBlock{
+		Columns: []string{"mode", "links", "owner", "group", "size", "month", "day", "time", "name"},
+		Select:  []string{"size", "name"},
+	}
+	in := []string{
+		"a:",
+		"-rw-r--r--  1 ana staff 1024 Mar  3 10:12 main.go",
+		"",
+		"b:",
+		"-rw-r--r--  1 ana staff 20480 Mar  3 10:12 release notes.md",
+	}
+	got := strings.Join(applyTable(block, in), "\n")
+	want := strings.Join([]string{
+		"a:",
+		"1024  main.go",
+		"",
+		"b:",
+		"20480  release notes.md",
+	}, "\n")
+	if got != want {
+		t.Errorf("applyTable:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTableHeaderEndsAtBlank(t *testing.T) {
+	in := []string{
+		"NAME   STATUS",
+		"web    Running",
+		"",
+		"done   in 2s",
+	}
+	got := strings.Join(applyTable(&TableBlock{Select: []string{"name"}}, in), "\n")
+	want := strings.Join([]string{"NAME", "web", "", "done   in 2s"}, "\n")
+	if got != want {
+		t.Errorf("applyTable:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// template is a parsed output template: literal text with placeholders like
+// {1}, {name} or {path|relpath|trunc:40}. Rendering is a single pass over the
+// parts, so a substituted value is never scanned for placeholders again.
+type template struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal string // the text as written; all there is when name is ""
+	name    string
+	funcs   []templateCall
+}
+
+type templateCall struct {
+	fn  templateFunc
+	arg string
+}
+
+// templateFunc transforms a placeholder value. arg is the text after the
+// colon in {name|fn:arg}, or "".
+type templateFunc func(value, arg string) string
+
+// templateFuncs is the whole function set. Functions are pure and leave
+// values they don't apply to (e.g. humanize on a non-number) unchanged.
+var templateFuncs = map[string]templateFunc{
+	"lower":    func(v, _ string) string { return strings.ToLower(v) },
+	"upper":    func(v, _ string) string { return strings.ToUpper(v) },
+	"trim":     func(v, _ string) string { return strings.TrimSpace(v) },
+	"trunc":    truncFunc,
+	"short":    shortFunc,
+	"relpath":  relpathFunc,
+	"basename": func(v, _ string) string { return filepath.Base(v) },
+	"humanize": humanizeFunc,
+}
+
+// placeholderRe matches one placeholder. Braces that don't form a valid
+// placeholder (e.g. "fn main() {") are literal text.
+var placeholderRe = regexp.MustCompile(`\{(\w+)((?:\|\w+(?::[^|{}]*)?)*)\}`)
+
+var (
+	templateCache   = make(map[string]*template)
+	templateCacheMu sync.RWMutex
+)
+
+// compileTemplate parses s, caching the result.
+func compileTemplate(s string) *template {
+	templateCacheMu.RLock()
+	t, ok := templateCache[s]
+	templateCacheMu.RUnlock()
+	if ok {
+		return t
+	}
+	t = parseTemplate(s)
+	templateCacheMu.Lock()
+	templateCache[s] = t
+	templateCacheMu.Unlock()
+	return t
+}
+
+func parseTemplate(s string) *template {
+	t := &template{}
+	last := 0
+	for _, loc := range placeholderRe.FindAllStringSubmatchIndex(s, -1) {
+		part, ok := parsePlaceholder(s[loc[2]:loc[3]], s[loc[4]:loc[5]])
+		if !ok {
+			continue
+		}
+		part.literal = s[loc[0]:loc[1]]
+		if loc[0] > last {
+			t.parts = append(t.parts, templatePart{literal: s[last:loc[0]]})
+		}
+		t.parts = append(t.parts, part)
+		last = loc[1]
+	}
+	if last < len(s) {
+		t.parts = append(t.parts, templatePart{literal: s[last:]})
+	}
+	return t
+}
+
+// parsePlaceholder builds the part for {name|fn:arg|...}. A placeholder
+// naming an unknown function is not one: it stays literal.
+func parsePlaceholder(name, pipeline string) (templatePart, bool) {
+	part := templatePart{name: name}
+	if pipeline == "" {
+		return part, true
+	}
+	for _, call := range strings.Split(pipeline[1:], "|") {
+		fnName, arg, _ := strings.Cut(call, ":")
+		fn, ok := templateFuncs[fnName]
+		if !ok {
+			return templatePart{}, false
+		}
+		part.funcs = append(part.funcs, templateCall{fn, arg})
+	}
+	return part, true
+}
+
+// render fills the placeholders with values from vars. Placeholders vars
+// has no value for are left as written.
+func (t *template) render(vars func(name string) (string, bool)) string {
+	if len(t.parts) == 1 && t.parts[0].name == "" {
+		return t.parts[0].literal
+	}
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.name == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		v, ok := vars(p.name)
+		if !ok {
+			b.WriteString(p.literal)
+			continue
+		}
+		for _, call := range p.funcs {
+			v = call.fn(v, call.arg)
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+// uses reports whether the template has a placeholder for name.
+func (t *template) uses(name string) bool {
+	for _, p := range t.parts {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchVars exposes a regex match to a template: {0} is the whole match,
+// {1}, {2}, ... the groups, and named groups also by name.
+func matchVars(re *regexp.Regexp, m []string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if i, err := strconv.Atoi(name); err == nil {
+			if i < len(m) {
+				return m[i], true
+			}
+			return "", false
+		}
+		if i := re.SubexpIndex(name); i >= 0 && i < len(m) {
+			return m[i], true
+		}
+		return "", false
+	}
+}
+
+// mapVars exposes a fixed set of values to a template.
+func mapVars(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+// truncFunc cuts v to at most arg runes, ending in "…" when cut.
+func truncFunc(v, arg string) string {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || utf8.RuneCountInString(v) <= n {
+		return v
+	}
+	runes := []rune(v)
+	return string(runes[:n-1]) + "…"
+}
+
+// shortFunc abbreviates a hex hash to arg characters (default 7).
+func shortFunc(v, arg string) string {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		n = 7
+	}
+	if len(v) <= n || strings.Trim(v, "0123456789abcdefABCDEF") != "" {
+		return v
+	}
+	return v[:n]
+}
+
+// relpathFunc makes an absolute path under the command's working directory
+// relative to it. Other paths are returned as is.
+func relpathFunc(v, _ string) string {
+	if !filepath.IsAbs(v) {
+		return v
+	}
+	rel, err := filepath.Rel(outputDir(), v)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return v
+	}
+	return rel
+}
+
+// humanizeFunc shortens a number: 1234 → 1.2k, 5300000 → 5.3M.
+func humanizeFunc(v, _ string) string {
+	n, err := strconv.ParseFloat(strings.ReplaceAll(v, ",", ""), 64)
+	if err != nil {
+		return v
+	}
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+	s := v
+	for _, unit := range []struct {
+		size   float64
+		suffix string
+	}{{1e12, "T"}, {1e9, "G"}, {1e6, "M"}, {1e3, "k"}} {
+		if n >= unit.size {
+			s = strconv.FormatFloat(n/unit.size, 'f', 1, 64)
+			s = strings.TrimSuffix(s, ".0") + unit.suffix
+			if neg {
+				s = "-" + s
+			}
+			break
+		}
+	}
+	return s
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TestReportBlock is the test_report field of [on_success] / [on_failure]:
+// it replaces the output with the failing tests and the totals. It decodes
+// from a format name (test_report = "go") or a table.
+type TestReportBlock struct {
+	Format    string // "go" (go test -json), "tap", "junit", "pytest"; "" detects it
+	Path      string // JUnit XML file, or a glob, relative to the working directory
+	MaxOutput int    // message and output lines shown per failing test (default 10)
+
+	unknown []string // keys rt doesn't know, reported by rt check
+}
+
+const defaultTestReportOutput = 10
+
+var testReportFormats = []string{"go", "tap", "junit", "pytest"}
+
+func (b *TestReportBlock) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		b.Format = v
+	case map[string]interface{}:
+		for key, value := range v {
+			var ok bool
+			switch key {
+			case "format":
+				b.Format, ok = value.(string)
+			case "path":
+				b.Path, ok = value.(string)
+			case "max_output":
+				var n int64
+				n, ok = value.(int64)
+				b.MaxOutput = int(n)
+			default:
+				b.unknown = append(b.unknown, key)
+				continue
+			}
+			if !ok {
+				return fmt.Errorf("test_report.%s: unexpected %T", key, value)
+			}
+		}
+		sort.Strings(b.unknown)
+	default:
+		return fmt.Errorf("expected a format name or a table, got %T", data)
+	}
+	if b.Format == "" && b.Path != "" {
+		b.Format = "junit"
+	}
+	if b.Format != "" && !anyOf(testReportFormats, func(f string) bool { return f == b.Format }) {
+		return fmt.Errorf("test_report: unknown format %q (want %s)", b.Format, strings.Join(testReportFormats, ", "))
+	}
+	return nil
+}
+
+// failedTest is one failing test as the report shows it.
+type failedTest struct {
+	name    string
+	message lineBuffer // assertion message, error, location
+	output  lineBuffer // captured output or stack
+}
+
+// lineBuffer keeps the first lines of a text and counts the rest.
+type lineBuffer struct {
+	lines   []string
+	dropped int
+}
+
+func (b *lineBuffer) add(line string, max int) {
+	if len(b.lines) < max {
+		b.lines = append(b.lines, line)
+	} else {
+		b.dropped++
+	}
+}
+
+func (b *lineBuffer) render(out []string) []string {
+	for _, line := range b.lines {
+		out = append(out, "  "+line)
+	}
+	if b.dropped > 0 {
+		out = append(out, fmt.Sprintf("  … %s", plural(b.dropped, "more line")))
+	}
+	return out
+}
+
+// testResults is what every test report parser produces.
+type testResults struct {
+	failures                []*failedTest
+	passed, failed, skipped int
+	other                   []string // lines outside the report worth keeping (e.g. build errors)
+}
+
+// testParser reads one test runner's output a line at a time.
+type testParser interface {
+	push(line string)
+	results() *testResults
+}
+
+// testReporter feeds the selected output lines to the parser for the
+// configured format, detecting the format from the output when it isn't
+// configured. It is nil when neither exit-code block has a test_report.
+type testReporter struct {
+	format string
+	max    int
+	parser testParser
+}
+
+func newTestReporter(f *Filter) *testReporter {
+	for _, b := range []*OutputBlock{f.OnFailure, f.OnSuccess} {
+		if b != nil && b.TestReport != nil {
+			r := &testReporter{format: b.TestReport.Format, max: b.TestReport.MaxOutput}
+			if r.max <= 0 {
+				r.max = defaultTestReportOutput
+			}
+			if r.format != "" && r.format != "junit" {
+				r.parser = newTestParser(r.format, r.max)
+			}
+			return r
+		}
+	}
+	return nil
+}
+
+func newTestParser(format string, max int) testParser {
+	switch format {
+	case "go":
+		return newGoTestParser(max)
+	case "tap":
+		return newTAPParser(max)
+	case "pytest":
+		return newPytestParser(max)
+	}
+	return nil
+}
+
+var (
+	goJSONLineRe     = regexp.MustCompile(`^\{.*"Action":`)
+	tapLineRe        = regexp.MustCompile(`^(TAP version \d+|\s*(not )?ok \d+\b)`)
+	pytestSessionRe  = regexp.MustCompile(`^=+ (test session starts|FAILURES|ERRORS|short test summary info) =+$`)
+	pytestSummaryRe  = regexp.MustCompile(`^(FAILED|ERROR) \S+::`)
+	pytestTotalsRe   = regexp.MustCompile(`^=*\s*(\d+ (failed|passed|skipped|errors?|xfailed|xpassed|deselected|warnings?)(, )?)+( in [\d.]+s.*)?\s*=*$`)
+	pytestTotalsPart = regexp.MustCompile(`(\d+) (failed|passed|skipped|errors?|xfailed|xpassed)`)
+)
+
+// detectTestFormat guesses the format from one output line, or returns "".
+func detectTestFormat(line string) string {
+	switch {
+	case goJSONLineRe.MatchString(line):
+		return "go"
+	case tapLineRe.MatchString(line):
+		return "tap"
+	case pytestSessionRe.MatchString(line), pytestSummaryRe.MatchString(line), pytestTotalsRe.MatchString(line):
+		return "pytest"
+	}
+	return ""
+}
+
+func (r *testReporter) push(line string) {
+	if r == nil || r.format == "junit" {
+		return
+	}
+	if r.parser == nil {
+		format := detectTestFormat(line)
+		if format == "" {
+			return
+		}
+		r.parser = newTestParser(format, r.max)
+	}
+	r.parser.push(line)
+}
+
+// report renders the failing tests and the totals for an exit-code block
+// with a test_report. It fails when the block has none or nothing was
+// recognized, and the block then works on the filtered lines as usual.
+// started is when the command started; JUnit files older than that are
+// left over from an earlier run and ignored.
+func (r *testReporter) report(block *TestReportBlock, started time.Time) ([]string, map[string]string, bool) {
+	if r == nil || block == nil {
+		return nil, nil, false
+	}
+	var res *testResults
+	if block.Path != "" || r.format == "junit" {
+		res = readJUnit(block.Path, started, r.max)
+	} else if r.parser != nil {
+		res = r.parser.results()
+	}
+	if res == nil {
+		return nil, nil, false
+	}
+	return res.render(), res.vars(), true
+}
+
+// apply replaces the lines an exit-code block works on with the test
+// report, when the block has one and it could be built, and adds the totals
+// to vars as {passed}, {failed} and {skipped}.
+func (r *testReporter) apply(block *OutputBlock, lines []string, full string, vars map[string]string, res runResult) ([]string, string) {
+	report, totals, ok := r.report(block.TestReport, res.Started)
+	if !ok {
+		return lines, full
+	}
+	for name, v := range totals {
+		vars[name] = v
+	}
+	return report, strings.Join(report, "\n")
+}
+
+// render lists each failing test with its message and output, then the
+// totals. Passing tests don't appear.
+func (res *testResults) render() []string {
+	out := append([]string(nil), res.other...)
+	for _, t := range res.failures {
+		out = append(out, "FAIL "+t.name)
+		out = t.message.render(out)
+		out = t.output.render(out)
+	}
+	return append(out, res.totals())
+}
+
+// totals renders e.g. "2 failed, 40 passed, 1 skipped".
+func (res *testResults) totals() string {
+	var parts []string
+	for _, c := range []struct {
+		n    int
+		what string
+	}{{res.failed, "failed"}, {res.passed, "passed"}, {res.skipped, "skipped"}} {
+		if c.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", c.n, c.what))
+		}
+	}
+	if len(parts) == 0 {
+		return "no tests ran"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// vars exposes the totals to the block's output template.
+func (res *testResults) vars() map[string]string {
+	return map[string]string{
+		"passed":  strconv.Itoa(res.passed),
+		"failed":  strconv.Itoa(res.failed),
+		"skipped": strconv.Itoa(res.skipped),
+	}
+}
+
+type goTestEvent struct {
+	Action     string
+	Package    string
+	ImportPath string
+	Test       string
+	Output     string
+}
+
+// goTestMarkerRe matches the lines go test writes around a test's own
+// output.
+var goTestMarkerRe = regexp.MustCompile(`^\s*(=== (RUN|PAUSE|CONT|NAME)|--- (PASS|FAIL|SKIP):)`)
+
+// goPackageNoiseRe matches the package-level status lines.
+var goPackageNoiseRe = regexp.MustCompile(`^(PASS|FAIL|ok|\?)(\s|$)|^coverage: `)
+
+type goTestParser struct {
+	max      int
+	res      testResults
+	output   map[string]*lineBuffer // running tests, by package + test
+	pkgOut   map[string]*lineBuffer // package-level output
+	failed   map[string]bool        // tests, parents and packages with a reported failure
+	reported map[string]bool        // packages whose build failure is already reported
+}
+
+func newGoTestParser(max int) *goTestParser {
+	return &goTestParser{
+		max:      max,
+		output:   make(map[string]*lineBuffer),
+		pkgOut:   make(map[string]*lineBuffer),
+		failed:   make(map[string]bool),
+		reported: make(map[string]bool),
+	}
+}
+
+func (p *goTestParser) push(line string) {
+	var ev goTestEvent
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &ev) != nil {
+		// Build errors from older go versions come as plain text
+		if strings.TrimSpace(line) != "" && len(p.res.other) < p.max*2 {
+			p.res.other = append(p.res.other, line)
+		}
+		return
+	}
+	switch ev.Action {
+	case "build-output":
+		pkg := goBuildPackage(ev.ImportPath)
+		// Skip the "# pkg" header; the failure is named after the package
+		if text := strings.TrimRight(ev.Output, "\n"); !strings.HasPrefix(text, "# ") {
+			p.buffer(p.pkgOut, pkg).add(text, p.max)
+		}
+	case "build-fail":
+		pkg := goBuildPackage(ev.ImportPath)
+		p.reported[pkg] = true
+		p.res.failed++
+		p.fail(pkg+" [build failed]", p.pkgOut[pkg])
+	case "output":
+		text := strings.TrimRight(ev.Output, "\n")
+		if ev.Test == "" {
+			if !goPackageNoiseRe.MatchString(text) && strings.TrimSpace(text) != "" {
+				p.buffer(p.pkgOut, ev.Package).add(text, p.max)
+			}
+			return
+		}
+		if goTestMarkerRe.MatchString(text) {
+			return
+		}
+		p.buffer(p.output, ev.Package+" "+ev.Test).add(strings.TrimSpace(text), p.max)
+	case "pass", "fail", "skip":
+		if ev.Test == "" {
+			if ev.Action == "fail" && !p.failed[ev.Package] && !p.reported[ev.Package] {
+				p.res.failed++
+				p.fail(ev.Package, p.pkgOut[ev.Package])
+			}
+			delete(p.pkgOut, ev.Package)
+			return
+		}
+		p.finish(ev)
+	}
+}
+
+func (p *goTestParser) finish(ev goTestEvent) {
+	key := ev.Package + " " + ev.Test
+	out := p.output[key]
+	delete(p.output, key)
+	switch ev.Action {
+	case "pass":
+		p.res.passed++
+		return
+	case "skip":
+		p.res.skipped++
+		return
+	}
+
+	p.failed[ev.Package] = true
+	if i := strings.LastIndex(ev.Test, "/"); i >= 0 {
+		p.failed[ev.Package+" "+ev.Test[:i]] = true
+	}
+	// A parent that only failed because of its subtests adds nothing
+	if p.failed[key] && (out == nil || len(out.lines) == 0) {
+		return
+	}
+	p.res.failed++
+	p.fail(ev.Package+"."+ev.Test, out)
+}
+
+func (p *goTestParser) fail(name string, out *lineBuffer) {
+	t := &failedTest{name: name}
+	if out != nil {
+		t.output = *out
+	}
+	p.res.failures = append(p.res.failures, t)
+}
+
+func (p *goTestParser) buffer(m map[string]*lineBuffer, key string) *lineBuffer {
+	b := m[key]
+	if b == nil {
+		b = &lineBuffer{}
+		m[key] = b
+	}
+	return b
+}
+
+func (p *goTestParser) results() *testResults {
+	return &p.res
+}
+
+// goBuildPackage turns a build ImportPath like "example.com/m/pkg
+// [example.com/m/pkg.test]" into the package path.
+func goBuildPackage(importPath string) string {
+	pkg, _, _ := strings.Cut(importPath, " ")
+	return pkg
+}
+
+var (
+	tapResultRe  = regexp.MustCompile(`^(\s*)(not ok|ok)\b(?:\s+\d+)?(?:\s+-)?\s*(.*?)(?:\s+#\s*(?i:(skip|todo))\b.*)?$`)
+	tapYAMLStart = regexp.MustCompile(`^\s*---\s*$`)
+	tapYAMLEnd   = regexp.MustCompile(`^\s*\.\.\.\s*$`)
+	// tapSummaryRe matches the closing comments of node:test and tape.
+	tapSummaryRe = regexp.MustCompile(`^# (tests|suites|pass|fail|cancelled|skipped|todo|duration_ms|ok)\b`)
+	// tapYAMLNoise are the YAML keys that say nothing about the failure.
+	tapYAMLNoise = regexp.MustCompile(`^(duration_ms|type|failureType|code):`)
+	// tapBlockScalarRe matches a YAML key whose value follows as a block.
+	tapBlockScalarRe = regexp.MustCompile(`^(\w+:) [|>][-+]?$`)
+	tapSubtestRe     = regexp.MustCompile(`^(\s*)# Subtest: (.+)$`)
+)
+
+type tapResult struct {
+	indent int
+	failed bool
+}
+
+// tapParser reads TAP. Nested subtests (node:test) are indented; a result
+// with results nested under it is a suite, which counts neither as a test
+// nor, when only its subtests failed, as a failure.
+type tapParser struct {
+	max      int
+	res      testResults
+	nested   []tapResult
+	subtests []tapSubtest // enclosing "# Subtest:" names, for failure names
+	last     *failedTest  // the failing test whose diagnostics come next
+	inYAML   bool
+}
+
+type tapSubtest struct {
+	indent int
+	name   string
+}
+
+func newTAPParser(max int) *tapParser {
+	return &tapParser{max: max}
+}
+
+func (p *tapParser) push(line string) {
+	if p.inYAML {
+		if tapYAMLEnd.MatchString(line) {
+			p.inYAML = false
+			return
+		}
+		if p.last != nil {
+			text := strings.TrimSpace(line)
+			if m := tapBlockScalarRe.FindStringSubmatch(text); m != nil {
+				text = m[1]
+			}
+			if text != "" && !tapYAMLNoise.MatchString(text) {
+				p.last.message.add(text, p.max)
+			}
+		}
+		return
+	}
+	if m := tapSubtestRe.FindStringSubmatch(line); m != nil {
+		p.subtests = append(p.enclosing(len(m[1])), tapSubtest{len(m[1]), m[2]})
+		return
+	}
+	if m := tapResultRe.FindStringSubmatch(line); m != nil {
+		p.result(len(m[1]), m[2] == "not ok", m[3], strings.ToLower(m[4]))
+		return
+	}
+	if tapYAMLStart.MatchString(line) {
+		p.inYAML = true
+		return
+	}
+	// "# ..." diagnostics after a failing test belong to it
+	if text := strings.TrimSpace(line); p.last != nil && strings.HasPrefix(text, "# ") && !tapSummaryRe.MatchString(text) {
+		p.last.message.add(strings.TrimPrefix(text, "# "), p.max)
+	}
+}
+
+// enclosing returns the subtests that enclose a line at indent.
+func (p *tapParser) enclosing(indent int) []tapSubtest {
+	n := 0
+	for n < len(p.subtests) && p.subtests[n].indent < indent {
+		n++
+	}
+	return p.subtests[:n]
+}
+
+func (p *tapParser) result(indent int, failed bool, name, directive string) {
+	suite, childFailed := false, false
+	for len(p.nested) > 0 && p.nested[len(p.nested)-1].indent > indent {
+		suite = true
+		childFailed = childFailed || p.nested[len(p.nested)-1].failed
+		p.nested = p.nested[:len(p.nested)-1]
+	}
+	p.nested = append(p.nested, tapResult{indent, failed && directive != "todo"})
+	p.last = nil
+
+	if suite && (!failed || childFailed) {
+		return
+	}
+	switch {
+	case directive != "":
+		p.res.skipped++
+	case failed:
+		p.res.failed++
+		for i := len(p.enclosing(indent)) - 1; i >= 0; i-- {
+			name = p.subtests[i].name + " › " + name
+		}
+		p.last = &failedTest{name: name}
+		p.res.failures = append(p.res.failures, p.last)
+	default:
+		p.res.passed++
+	}
+}
+
+func (p *tapParser) results() *testResults {
+	return &p.res
+}
+
+var (
+	pytestSectionRe  = regexp.MustCompile(`^=+ (.+?) =+$`)
+	pytestTestRe     = regexp.MustCompile(`^_{3,} (.+?) _{3,}$`)
+	pytestCaptureRe  = regexp.MustCompile(`^-+ Captured (.+?) -+$`)
+	pytestErrorRe    = regexp.MustCompile(`^E\s+(.*)$`)
+	pytestLocationRe = regexp.MustCompile(`^\S+\.py:\d+: \S+$`)
+	pytestShortRe    = regexp.MustCompile(`^(FAILED|ERROR) (\S+)(?: - (.*))?$`)
+)
+
+// pytestParser reads pytest's default and -q output: the FAILURES and
+// ERRORS sections for messages and captured output, the short test summary
+// for node ids, and the final counts line for the totals.
+type pytestParser struct {
+	max      int
+	res      testResults
+	section  string
+	current  *failedTest
+	capture  bool
+	byName   map[string]*failedTest
+	counted  bool
+	reported map[string]bool
+}
+
+func newPytestParser(max int) *pytestParser {
+	return &pytestParser{max: max, byName: make(map[string]*failedTest), reported: make(map[string]bool)}
+}
+
+func (p *pytestParser) push(line string) {
+	if pytestTotalsRe.MatchString(line) {
+		p.totals(line)
+		return
+	}
+	if m := pytestSectionRe.FindStringSubmatch(line); m != nil {
+		p.section = strings.ToLower(m[1])
+		p.current, p.capture = nil, false
+		return
+	}
+	switch p.section {
+	case "failures", "errors":
+		if m := pytestTestRe.FindStringSubmatch(line); m != nil {
+			p.current = &failedTest{name: m[1]}
+			p.capture = false
+			p.byName[m[1]] = p.current
+			p.res.failures = append(p.res.failures, p.current)
+			return
+		}
+		if p.current == nil {
+			return
+		}
+		if m := pytestCaptureRe.FindStringSubmatch(line); m != nil {
+			p.capture = true
+			p.current.output.add("captured "+m[1]+":", p.max)
+			return
+		}
+		if p.capture {
+			p.current.output.add(line, p.max)
+		} else if m := pytestErrorRe.FindStringSubmatch(line); m != nil {
+			p.current.message.add(m[1], p.max)
+		} else if pytestLocationRe.MatchString(line) {
+			p.current.message.add(line, p.max)
+		}
+	case "short test summary info":
+		if m := pytestShortRe.FindStringSubmatch(line); m != nil {
+			p.summary(m[2], m[3])
+		}
+	}
+}
+
+// summary names a failure by its node id, or adds it when the FAILURES
+// section didn't list it (e.g. --tb=no).
+func (p *pytestParser) summary(nodeID, message string) {
+	for name, t := range p.byName {
+		test := strings.ReplaceAll(strings.TrimPrefix(name, "ERROR at setup of "), ".", "::")
+		if strings.HasSuffix(nodeID, "::"+test) && !p.reported[name] {
+			t.name = nodeID
+			p.reported[name] = true
+			return
+		}
+	}
+	t := &failedTest{name: nodeID}
+	if message != "" {
+		t.message.add(message, p.max)
+	}
+	p.res.failures = append(p.res.failures, t)
+}
+
+func (p *pytestParser) totals(line string) {
+	p.counted = true
+	for _, m := range pytestTotalsPart.FindAllStringSubmatch(line, -1) {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "passed", "xpassed":
+			p.res.passed += n
+		case "failed", "error", "errors":
+			p.res.failed += n
+		case "skipped", "xfailed":
+			p.res.skipped += n
+		}
+	}
+}
+
+func (p *pytestParser) results() *testResults {
+	if !p.counted {
+		p.res.failed = len(p.res.failures)
+	}
+	return &p.res
+}
+
+type junitCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *struct{}     `xml:"skipped"`
+	SystemOut string        `xml:"system-out"`
+	SystemErr string        `xml:"system-err"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// readJUnit reads the test cases of the JUnit XML files matching pattern,
+// which is relative to the command's working directory. Only files written
+// since started count; without a start time (the output didn't come from a
+// run) none does. It returns nil when no file matches or none can be read.
+func readJUnit(pattern string, started time.Time, max int) *testResults {
+	if pattern == "" || started.IsZero() {
+		return nil
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(outputDir(), pattern)
+	}
+	// File timestamps may be coarser than the clock
+	started = started.Add(-time.Second)
+	paths, _ := filepath.Glob(pattern)
+	var res *testResults
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Before(started) {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		if res == nil {
+			res = &testResults{}
+		}
+		dec := xml.NewDecoder(f)
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				break
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok || start.Name.Local != "testcase" {
+				continue
+			}
+			var c junitCase
+			if dec.DecodeElement(&c, &start) == nil {
+				res.add(c, max)
+			}
+		}
+		f.Close()
+	}
+	return res
+}
+
+func (res *testResults) add(c junitCase, max int) {
+	failure := c.Failure
+	if failure == nil {
+		failure = c.Error
+	}
+	switch {
+	case failure != nil:
+		res.failed++
+	case c.Skipped != nil:
+		res.skipped++
+		return
+	default:
+		res.passed++
+		return
+	}
+
+	name := c.Name
+	if c.Classname != "" && !strings.Contains(c.Name, c.Classname) {
+		name = c.Classname + "." + c.Name
+	}
+	t := &failedTest{name: name}
+	message := strings.TrimSpace(failure.Message)
+	for _, line := range splitLines(message) {
+		t.message.add(line, max)
+	}
+	for _, text := range []string{failure.Text, c.SystemOut, c.SystemErr} {
+		for _, line := range splitLines(strings.TrimSpace(text)) {
+			// The body often starts by repeating the message
+			text := strings.TrimSpace(line)
+			if text == "" || (len(t.output.lines) == 0 && message != "" && (strings.Contains(message, text) || strings.Contains(text, message))) {
+				continue
+			}
+			t.output.add(strings.TrimRight(line, " \t"), max)
+		}
+	}
+	res.failures = append(res.failures, t)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadJUnit(t *testing.T) {
+	dir := t.TempDir()
+	old := workDir
+	workDir = dir
+	t.Cleanup(func() { workDir = old })
+
+	path := filepath.Join(dir, "junit.xml")
+	xml := `<testsuites><testsuite name="cart">
+<testcase classname="cart" name="adds"/>
+<testcase classname="cart" name="totals"><failure message="expected 6">at cart.test.js:14</failure></testcase>
+</testsuite></testsuites>`
+	if err := os.WriteFile(path, []byte(xml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+
+	res := readJUnit("junit.xml", started, 10)
+	if res == nil || res.passed != 1 || res.failed != 1 {
+		t.Fatalf("readJUnit(relative path) = %+v; want 1 passed, 1 failed", res)
+	}
+	if res := readJUnit("junit.xml", time.Time{}, 10); res != nil {
+		t.Errorf("readJUnit without a start time = %+v; want nil", res)
+	}
+
+	stale := started.Add(-time.Hour)
+	if err := os.Chtimes(path, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if res := readJUnit("junit.xml", started, 10); res != nil {
+		t.Errorf("readJUnit(stale file) = %+v; want nil", res)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-isatty"
+)
+
+// pipelineTrace records what each stage of a filter did: its line and
+// token counts, how long it took, and which lines it dropped, rewrote or
+// wrote. Input lines are followed through the stages, so the side-by-side
+// view can show where each one ended up. A nil trace records nothing.
+type pipelineTrace struct {
+	input  []string
+	origin []int    // input line of each current line; -1 for lines a stage wrote
+	fate   []string // per input line, the stage or rule that dropped it
+	lines  []string // the current lines
+	stages []traceStage
+}
+
+type traceStage struct {
+	name                string
+	inLines, outLines   int
+	inTokens, outTokens int
+	elapsed             time.Duration
+	events              []traceEvent
+}
+
+type traceEvent struct {
+	kind byte // '-' dropped, '~' rewritten, '+' written by the stage, '=' short-circuit
+	line string
+	to   string // the new text of a rewritten line
+	rule string
+}
+
+func newPipelineTrace() *pipelineTrace {
+	return &pipelineTrace{}
+}
+
+func (tr *pipelineTrace) start(raw string) {
+	if tr == nil {
+		return
+	}
+	tr.input = splitLines(raw)
+	tr.lines = tr.input
+	tr.origin = make([]int, len(tr.input))
+	for i := range tr.origin {
+		tr.origin[i] = i
+	}
+	tr.fate = make([]string, len(tr.input))
+}
+
+// begin starts timing a stage that receives in. The returned function
+// records the stage with its output. explain names the rule that dropped
+// or rewrote a line; without it, the stage name is used.
+func (tr *pipelineTrace) begin(name string, in []string, explain func(line string) string) func(out []string) {
+	if tr == nil {
+		return func([]string) {}
+	}
+	t0 := time.Now()
+	return func(out []string) {
+		tr.record(name, in, out, time.Since(t0), explain, false)
+	}
+}
+
+// beginQuiet is begin for a stage whose per-line changes aren't worth
+// listing, like strip_ansi rewriting every colored line.
+func (tr *pipelineTrace) beginQuiet(name string, in []string) func(out []string) {
+	if tr == nil {
+		return func([]string) {}
+	}
+	t0 := time.Now()
+	return func(out []string) {
+		tr.record(name, in, out, time.Since(t0), nil, true)
+	}
+}
+
+// shortCircuit records a match_output rule replacing the whole output.
+func (tr *pipelineTrace) shortCircuit(rule string, in, out []string) {
+	if tr == nil {
+		return
+	}
+	tr.stages = append(tr.stages, traceStage{
+		name:    "match_output",
+		inLines: len(in), outLines: len(out),
+		inTokens: linesTokens(in), outTokens: linesTokens(out),
+		events: []traceEvent{{kind: '=', rule: rule}},
+	})
+	for i := range tr.fate {
+		tr.fate[i] = rule
+	}
+	tr.lines = out
+	tr.origin = make([]int, len(out))
+	for i := range tr.origin {
+		tr.origin[i] = -1
+	}
+}
+
+func (tr *pipelineTrace) record(name string, in, out []string, elapsed time.Duration, explain func(string) string, quiet bool) {
+	st := traceStage{
+		name:    name,
+		inLines: len(in), outLines: len(out),
+		inTokens: linesTokens(in), outTokens: linesTokens(out),
+		elapsed: elapsed,
+	}
+	rule := func(line string) string {
+		if explain != nil {
+			return explain(line)
+		}
+		return name
+	}
+
+	match := alignLines(in, out)
+	origin := make([]int, len(out))
+	drop := func(i int) {
+		r := rule(in[i])
+		if !quiet {
+			st.events = append(st.events, traceEvent{kind: '-', line: in[i], rule: r})
+		}
+		if i < len(tr.origin) && tr.origin[i] >= 0 && tr.fate[tr.origin[i]] == "" {
+			tr.fate[tr.origin[i]] = r
+		}
+	}
+	next := 0
+	for j, k := range match {
+		origin[j] = -1
+		if k < 0 {
+			if !quiet {
+				st.events = append(st.events, traceEvent{kind: '+', line: out[j]})
+			}
+			continue
+		}
+		for ; next < k; next++ {
+			drop(next)
+		}
+		next = k + 1
+		if k < len(tr.origin) {
+			origin[j] = tr.origin[k]
+		}
+		if in[k] != out[j] && !quiet {
+			st.events = append(st.events, traceEvent{kind: '~', line: in[k], to: out[j], rule: rule(in[k])})
+		}
+	}
+	for ; next < len(in); next++ {
+		drop(next)
+	}
+	tr.stages = append(tr.stages, st)
+	tr.lines, tr.origin = out, origin
+}
+
+// alignLines returns, for each line of out, the index of the line of in it
+// comes from, or -1 for a line the stage wrote. A stage that keeps the line
+// count rewrites lines in place; otherwise out is matched to in as a
+// subsequence of equal lines.
+func alignLines(in, out []string) []int {
+	match := make([]int, len(out))
+	if len(in) == len(out) {
+		for j := range out {
+			match[j] = j
+		}
+		return match
+	}
+	positions := make(map[string][]int, len(in))
+	for i, line := range in {
+		positions[line] = append(positions[line], i)
+	}
+	next := 0
+	for j, line := range out {
+		match[j] = -1
+		list := positions[line]
+		for len(list) > 0 && list[0] < next {
+			list = list[1:]
+		}
+		if len(list) > 0 {
+			match[j] = list[0]
+			next = list[0] + 1
+			list = list[1:]
+		}
+		positions[line] = list
+	}
+	return match
+}
+
+func linesTokens(lines []string) int {
+	if len(lines) == 0 {
+		return 0
+	}
+	return estimateTokens(strings.Join(lines, "\n") + "\n")
+}
+
+// patternRule explains a line dropped by a skip list: the first pattern
+// that matches it.
+func patternRule(key string, patterns []string) func(string) string {
+	regexes := compilePatterns(patterns)
+	return func(line string) string {
+		for i, re := range regexes {
+			if re.MatchString(line) {
+				return fmt.Sprintf("%s[%d] `%s`", key, i, re)
+			}
+		}
+		return key
+	}
+}
+
+// replaceRule explains a line rewritten by [[replace]] or [[collapse]].
+func replaceRule(key string, rules []ReplaceRule) func(string) string {
+	compiled := compileReplaceRules(rules)
+	return func(line string) string {
+		for i, cr := range compiled {
+			if cr.re.MatchString(line) {
+				return fmt.Sprintf("%s[%d] `%s`", key, i, cr.re)
+			}
+		}
+		return key
+	}
+}
+
+// blockRule explains a line dropped by an exit-code block: its skip
+// patterns, its keep list, or else whichever of start_at, head, tail and
+// output the block sets.
+func blockRule(key string, b *OutputBlock) func(string) string {
+	skip := patternRule(key+".skip", b.Skip)
+	keep := compilePatterns(b.Keep)
+	var cuts []string
+	for _, c := range []struct {
+		name string
+		set  bool
+	}{{"start_at", b.StartAt != ""}, {"head", b.Head > 0}, {"tail", b.Tail > 0}, {"output", b.Output != ""}} {
+		if c.set {
+			cuts = append(cuts, c.name)
+		}
+	}
+	rest := key
+	if len(cuts) > 0 {
+		rest += "." + strings.Join(cuts, "/")
+	}
+	return func(line string) string {
+		if r := skip(line); r != key+".skip" {
+			return r
+		}
+		if len(keep) > 0 && !matchesAny(keep, line) {
+			return key + ".keep"
+		}
+		return rest
+	}
+}
+
+const (
+	traceRed    = "\x1b[31m"
+	traceGreen  = "\x1b[32m"
+	traceYellow = "\x1b[33m"
+	traceDim    = "\x1b[2m"
+	traceBold   = "\x1b[1m"
+	traceReset  = "\x1b[0m"
+)
+
+// tracePainter colors trace output when it goes to a terminal.
+type tracePainter bool
+
+func (p tracePainter) paint(color, s string) string {
+	if !p || s == "" {
+		return s
+	}
+	return color + s + traceReset
+}
+
+// renderStages prints one line per stage with its counts and timing and,
+// with events set, the lines each stage dropped, rewrote or wrote.
+func (tr *pipelineTrace) renderStages(w io.Writer, p tracePainter, events bool) {
+	fmt.Fprintf(w, "%s %s, %s\n", p.paint(traceBold, fmt.Sprintf("%-12s", "input")), plural(len(tr.input), "line"), plural(linesTokens(tr.input), "token"))
+	for _, st := range tr.stages {
+		change := ""
+		if len(st.events) == 0 && st.inLines == st.outLines && st.inTokens == st.outTokens {
+			change = "  (no change)"
+		}
+		fmt.Fprintf(w, "%s %d → %d lines, %d → %d tokens, %s%s\n",
+			p.paint(traceBold, fmt.Sprintf("%-12s", st.name)), st.inLines, st.outLines,
+			st.inTokens, st.outTokens, formatElapsed(st.elapsed), change)
+		if !events {
+			continue
+		}
+		for _, e := range st.events {
+			switch e.kind {
+			case '-':
+				fmt.Fprintf(w, "  %s  %s\n", p.paint(traceRed, "- "+e.line), p.paint(traceDim, "← "+e.rule))
+			case '~':
+				fmt.Fprintf(w, "  %s\n    %s  %s\n", p.paint(traceYellow, "~ "+e.line), p.paint(traceGreen, "→ "+e.to), p.paint(traceDim, "← "+e.rule))
+			case '+':
+				fmt.Fprintf(w, "  %s\n", p.paint(traceGreen, "+ "+e.line))
+			case '=':
+				fmt.Fprintf(w, "  %s\n", p.paint(traceYellow, e.rule+" matched: the output is replaced and the other stages are skipped"))
+			}
+		}
+	}
+}
+
+// renderSideBySide prints every input line next to what became of it: the
+// line as printed, or the rule that dropped it. Lines written by a stage
+// appear on the right only.
+func (tr *pipelineTrace) renderSideBySide(w io.Writer, p tracePainter, width int) {
+	col := max((width-3)/2, 10)
+	row := func(left, right, color string) {
+		left = fitWidth(left, col)
+		fmt.Fprintf(w, "%s%s%s%s\n", left, strings.Repeat(" ", col-utf8.RuneCountInString(left)),
+			p.paint(traceDim, " │ "), p.paint(color, fitWidth(right, col)))
+	}
+	next := 0
+	dropped := func(upTo int) {
+		for ; next < upTo; next++ {
+			row(tr.input[next], "✗ "+tr.fate[next], traceRed)
+		}
+	}
+	for j, line := range tr.lines {
+		o := tr.origin[j]
+		if o < next {
+			row("", line, traceGreen)
+			continue
+		}
+		dropped(o)
+		color := ""
+		if line != tr.input[o] {
+			color = traceYellow
+		}
+		row(tr.input[o], line, color)
+		next = o + 1
+	}
+	dropped(len(tr.input))
+}
+
+func formatElapsed(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return fmt.Sprintf("%dµs", d.Microseconds())
+	case d < time.Second:
+		return fmt.Sprintf("%.1fms", float64(d.Microseconds())/1000)
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+// fitWidth cuts s to n runes, ending in "…" when cut, and expands tabs so
+// columns line up.
+func fitWidth(s string, n int) string {
+	s = strings.ReplaceAll(s, "\t", "    ")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// terminalWidth is $COLUMNS, or 160.
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 160
+}
+
+// printTrace prints a trace and the output it led to.
+func printTrace(tr *pipelineTrace, output string, sideBySide bool) {
+	p := tracePainter(isatty.IsTerminal(os.Stdout.Fd()))
+	tr.renderStages(os.Stdout, p, !sideBySide)
+	if sideBySide {
+		fmt.Println()
+		tr.renderSideBySide(os.Stdout, p, terminalWidth())
+	}
+	in, out := linesTokens(tr.input), estimateTokens(output)
+	saved := 0
+	if in > 0 {
+		saved = (in - out) * 100 / in
+	}
+	fmt.Printf("\n%s\n", p.paint(traceBold, fmt.Sprintf("── output: %s, %s (%d%% saved)", plural(len(splitLines(output)), "line"), plural(out, "token"), saved)))
+	fmt.Print(output)
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		fmt.Println()
+	}
+}
+
+// cmdTrace runs a sample through a filter and shows what each stage did:
+// rt trace <filter | file.toml> [--exit N] [--side-by-side] [sample]
+func cmdTrace(args []string) {
+	usage := "rt: usage: rt trace <filter | file.toml> [--exit N] [--side-by-side] [sample file]"
+	exitCode := 0
+	sideBySide := false
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "--side-by-side":
+			sideBySide = true
+		case a == "--exit" || strings.HasPrefix(a, "--exit="):
+			value, ok := strings.CutPrefix(a, "--exit=")
+			if !ok {
+				if i+1 >= len(args) {
+					fmt.Fprintln(os.Stderr, usage)
+					os.Exit(1)
+				}
+				i++
+				value = args[i]
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rt: invalid --exit %q\n", value)
+				os.Exit(1)
+			}
+			exitCode = n
+		default:
+			positional = append(positional, a)
+		}
+	}
+	if len(positional) == 0 || len(positional) > 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	f := loadFilterArg(positional[0])
+	var data []byte
+	var err error
+	if len(positional) == 2 {
+		data, err = os.ReadFile(positional[1])
+	} else {
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rt: %v\n", err)
+		os.Exit(1)
+	}
+
+	tr := newPipelineTrace()
+	output := applyFilterTraced(f, textResult(string(data), exitCode), tr)
+	printTrace(tr, output, sideBySide)
+}
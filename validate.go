@@ -0,0 +1,480 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// filterProblem is a rule that can't be applied as written: a regex that
+// doesn't compile, a template referring to a group the pattern doesn't have,
+// a key rt doesn't know. Such rules are ignored at run time.
+type filterProblem struct {
+	Key       string // e.g. "skip[2]", "section[0].replace[1].output"
+	Line, Col int    // position of the key in the file; 0 when unknown
+	Msg       string
+}
+
+func (p filterProblem) String() string {
+	if p.Line == 0 {
+		return p.Key + ": " + p.Msg
+	}
+	return fmt.Sprintf("%d:%d: %s: %s", p.Line, p.Col, p.Key, p.Msg)
+}
+
+// filterLinter collects the problems of one filter.
+type filterLinter struct {
+	problems []filterProblem
+}
+
+func (l *filterLinter) add(key, format string, args ...interface{}) {
+	l.problems = append(l.problems, filterProblem{Key: key, Msg: fmt.Sprintf(format, args...)})
+}
+
+// regex compiles pattern, recording a problem and returning nil if it
+// doesn't compile.
+func (l *filterLinter) regex(key, pattern string) *regexp.Regexp {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		msg := err.Error()
+		if e, ok := err.(*syntax.Error); ok {
+			msg = fmt.Sprintf("%s: `%s`", e.Code, e.Expr)
+		}
+		l.add(key, "invalid regex: %s", msg)
+		return nil
+	}
+	return re
+}
+
+func (l *filterLinter) regexes(key string, patterns []string) {
+	for i, p := range patterns {
+		l.regex(fmt.Sprintf("%s[%d]", key, i), p)
+	}
+}
+
+// template checks an output template: every placeholder with a pipeline
+// must name known functions, and with re set, every {n} must be one of its
+// groups.
+func (l *filterLinter) template(key, tmpl string, re *regexp.Regexp) {
+	for _, m := range placeholderRe.FindAllStringSubmatch(tmpl, -1) {
+		if _, ok := parsePlaceholder(m[1], m[2]); !ok {
+			l.add(key, "unknown function in %s (known: %s)", m[0], strings.Join(templateFuncNames(), ", "))
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || re == nil || n <= re.NumSubexp() {
+			continue
+		}
+		l.add(key, "%s refers to group %d, but the pattern has %s", m[0], n, plural(re.NumSubexp(), "group"))
+	}
+}
+
+func templateFuncNames() []string {
+	names := make([]string, 0, len(templateFuncs))
+	for name := range templateFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (l *filterLinter) replaceRules(key string, rules []ReplaceRule) {
+	for i, r := range rules {
+		k := fmt.Sprintf("%s[%d]", key, i)
+		if re := l.regex(k+".pattern", r.Pattern); re != nil {
+			l.template(k+".output", r.Output, re)
+		}
+	}
+}
+
+func (l *filterLinter) outputBlock(key string, b *OutputBlock) {
+	if b == nil {
+		return
+	}
+	l.regexes(key+".skip", b.Skip)
+	l.regexes(key+".keep", b.Keep)
+	if b.StartAt != "" {
+		l.regex(key+".start_at", b.StartAt)
+	}
+	l.template(key+".output", b.Output, nil)
+	if b.TestReport != nil {
+		l.unknownKeys(key+".test_report", b.TestReport.unknown)
+	}
+}
+
+// unknownKeys reports the keys a block with its own UnmarshalTOML set
+// aside; TOML marks them decoded, so they never reach md.Undecoded.
+func (l *filterLinter) unknownKeys(key string, unknown []string) {
+	for _, k := range unknown {
+		l.add(key+"."+k, "unknown key")
+	}
+}
+
+// streamedBlock flags head and tail on a branch of a stream = true filter:
+// the lines are printed as they arrive, so there is nothing left to trim.
+func (l *filterLinter) streamedBlock(key string, b *OutputBlock) {
+	if b == nil || b.summarizes() {
+		return
+	}
+	if b.Head > 0 {
+		l.add(key+".head", "has no effect with stream = true")
+	}
+	if b.Tail > 0 {
+		l.add(key+".tail", "has no effect with stream = true")
+	}
+}
+
+// rowRules checks a keep_rows / skip_rows map in key order.
+func (l *filterLinter) rowRules(key string, rules map[string]string) {
+	cols := make([]string, 0, len(rules))
+	for col := range rules {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	for _, col := range cols {
+		l.regex(key+"."+col, rules[col])
+	}
+}
+
+// lintFilter checks every regex and template of f.
+func lintFilter(f *Filter) []filterProblem {
+	l := &filterLinter{}
+	l.regexes("skip_stdout", f.SkipStdout)
+	l.regexes("skip_stderr", f.SkipStderr)
+	l.regexes("keep_stdout", f.KeepStdout)
+	l.regexes("keep_stderr", f.KeepStderr)
+	if f.StackTrace != nil {
+		l.regexes("stacktrace.library", f.StackTrace.Library)
+	}
+	if f.Diff != nil {
+		for i, g := range f.Diff.Generated {
+			if _, err := path.Match(strings.TrimSuffix(g, "/"), ""); err != nil {
+				l.add(fmt.Sprintf("diff.generated[%d]", i), "invalid glob %q", g)
+			}
+		}
+	}
+	if j := f.JSON; j != nil {
+		if _, err := parseJSONPath(j.Root); err != nil {
+			l.add("json.root", "invalid path: %v", err)
+		}
+		for i, spec := range j.Fields {
+			if _, err := parseJSONFields([]string{spec}); err != nil {
+				l.add(fmt.Sprintf("json.fields[%d]", i), "invalid path: %v", err)
+			}
+		}
+		if j.Format != "" && j.Format != "json" && j.Format != "tsv" {
+			l.add("json.format", "unknown format %q (known: json, tsv)", j.Format)
+		}
+	}
+	switch f.Streams {
+	case "", "both", "stderr", "stdout":
+	default:
+		l.add("streams", "unknown value %q (known: both, stderr, stdout)", f.Streams)
+	}
+	l.unknownKeys("diagnostics", f.Diagnostics.unknown)
+	l.regexes("skip", f.Skip)
+	l.regexes("keep", f.Keep)
+	for i, s := range f.Sections {
+		key := fmt.Sprintf("section[%d]", i)
+		if s.Start == "" {
+			l.add(key, "start is required")
+		} else {
+			l.regex(key+".start", s.Start)
+		}
+		if s.End != "" {
+			l.regex(key+".end", s.End)
+		}
+		l.regexes(key+".skip", s.Skip)
+		l.regexes(key+".keep", s.Keep)
+		l.replaceRules(key+".replace", s.Replace)
+	}
+	if t := f.Table; t != nil {
+		if t.Header != "" {
+			l.regex("table.header", t.Header)
+		}
+		l.rowRules("table.keep_rows", t.KeepRows)
+		l.rowRules("table.skip_rows", t.SkipRows)
+	}
+	l.replaceRules("replace", f.Replace)
+	l.replaceRules("collapse", f.Collapse)
+	for i, c := range f.Count {
+		key := fmt.Sprintf("count[%d]", i)
+		if c.Name == "" {
+			l.add(key, "name is required")
+		}
+		re := l.regex(key+".pattern", c.Pattern)
+		if re != nil && c.Sum && re.NumSubexp() == 0 {
+			l.add(key+".pattern", "sum needs a capture group holding the number")
+		}
+	}
+	for i, m := range f.MatchOutput {
+		key := fmt.Sprintf("match_output[%d]", i)
+		var re *regexp.Regexp
+		if m.Matches != "" {
+			re = l.regex(key+".matches", m.Matches)
+		}
+		l.template(key+".output", m.Output, re)
+	}
+	l.regexes("important", f.Important)
+	l.outputBlock("on_success", f.OnSuccess)
+	l.outputBlock("on_failure", f.OnFailure)
+	if f.Stream {
+		l.streamedBlock("on_success", f.OnSuccess)
+		l.streamedBlock("on_failure", f.OnFailure)
+	}
+	return l.problems
+}
+
+// decodeFilter parses a filter and checks it: it returns the filter, its
+// problems with their positions in data, and an error only when data isn't
+// a valid filter at all (bad TOML, a value of the wrong type).
+func decodeFilter(data []byte) (Filter, []filterProblem, error) {
+	var f Filter
+	md, err := toml.Decode(string(data), &f)
+	if err != nil {
+		return f, nil, err
+	}
+	keys := scanTOMLKeys(data)
+
+	var problems []filterProblem
+	used := make(map[int]bool)
+	undecoded := make(map[string]bool)
+	for _, k := range md.Undecoded() {
+		name := strings.Join(k, ".")
+		undecoded[name] = true
+		// Report a misspelled table once, not each of its keys
+		if len(k) > 1 && undecoded[strings.Join(k[:len(k)-1], ".")] {
+			continue
+		}
+		p := filterProblem{Key: name, Msg: "unknown key"}
+		for i, sk := range keys {
+			if !used[i] && sk.plain == name {
+				used[i] = true
+				p.Key, p.Line, p.Col = sk.indexed, sk.line, sk.col
+				break
+			}
+		}
+		problems = append(problems, p)
+	}
+	for _, p := range lintFilter(&f) {
+		p.Line, p.Col = keyPosition(keys, p.Key)
+		problems = append(problems, p)
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+	return f, problems, nil
+}
+
+// in prefixes the problem with the file it is in, compiler style.
+func (p filterProblem) in(file string) string {
+	if p.Line == 0 {
+		return file + ": " + p.String()
+	}
+	return file + ":" + p.String()
+}
+
+// describeDecodeError renders an error of decodeFilter with the file and,
+// for TOML syntax errors, the line and column.
+func describeDecodeError(file string, err error) string {
+	if pe, ok := err.(toml.ParseError); ok {
+		return fmt.Sprintf("%s:%d:%d: %s", file, pe.Position.Line, pe.Position.Col, pe.Message)
+	}
+	return file + ": " + err.Error()
+}
+
+// tomlKey is a key or table header found in a TOML file.
+type tomlKey struct {
+	plain     string // "section.replace.pattern"
+	indexed   string // "section[1].replace[0].pattern"
+	line, col int
+}
+
+var (
+	tomlBareKey  = `(?:[A-Za-z0-9_-]+|"[^"]*"|'[^']*')`
+	tomlHeaderRe = regexp.MustCompile(`^\s*(\[\[?)\s*(` + tomlBareKey + `(?:\s*\.\s*` + tomlBareKey + `)*)\s*\]`)
+	tomlKeyRe    = regexp.MustCompile(`^\s*(` + tomlBareKey + `(?:\s*\.\s*` + tomlBareKey + `)*)\s*=`)
+	tomlPartRe   = regexp.MustCompile(tomlBareKey)
+)
+
+// scanTOMLKeys lists the keys and table headers of a TOML file with their
+// positions, which toml.MetaData doesn't expose. Array tables get their
+// index, so the nth [[replace]] is "replace[n]", and so do the elements of
+// array values: the second pattern of skip is "skip[1]", at its own line.
+// Lines inside multi-line strings are skipped; keys inside inline tables are
+// not listed.
+func scanTOMLKeys(data []byte) []tomlKey {
+	var keys []tomlKey
+	arrays := make(map[string]int) // indexed path of an array table → current index
+	plainTable, indexedTable := "", ""
+	inString := ""
+	lines := strings.Split(string(data), "\n")
+	for n := 0; n < len(lines); n++ {
+		line := lines[n]
+		if inString != "" {
+			if strings.Count(line, inString)%2 == 1 {
+				inString = ""
+			}
+			continue
+		}
+		if m := tomlHeaderRe.FindStringSubmatch(line); m != nil {
+			parts := keyParts(m[2])
+			plainTable, indexedTable = strings.Join(parts, "."), ""
+			for i, part := range parts {
+				indexedTable = joinKey(indexedTable, part)
+				last := i == len(parts)-1
+				if last && m[1] == "[[" {
+					arrays[indexedTable]++
+				}
+				if idx, ok := arrays[indexedTable]; ok {
+					indexedTable += fmt.Sprintf("[%d]", idx-1)
+				}
+			}
+			col := strings.Index(line, "[") + 1
+			keys = append(keys, tomlKey{plainTable, indexedTable, n + 1, col})
+			continue
+		}
+		m := tomlKeyRe.FindStringSubmatchIndex(line)
+		if m == nil {
+			continue
+		}
+		name := strings.Join(keyParts(line[m[2]:m[3]]), ".")
+		indexed := joinKey(indexedTable, name)
+		keys = append(keys, tomlKey{joinKey(plainTable, name), indexed, n + 1, m[2] + 1})
+
+		value := line[m[1]:]
+		if trimmed := strings.TrimLeft(value, " \t"); strings.HasPrefix(trimmed, "[") {
+			start := len(line) - len(trimmed)
+			elements, end := arrayElements(lines, n, start)
+			for i, pos := range elements {
+				keys = append(keys, tomlKey{"", fmt.Sprintf("%s[%d]", indexed, i), pos[0], pos[1]})
+			}
+			n = end
+			continue
+		}
+		for _, quote := range []string{`'''`, `"""`} {
+			if strings.Count(value, quote)%2 == 1 {
+				inString = quote
+			}
+		}
+	}
+	return keys
+}
+
+// arrayElements finds the elements of the array value whose '[' is at
+// lines[n][col]. It returns their 1-based line and column and the index of
+// the line the array ends on. A nested array or inline table is one element.
+func arrayElements(lines []string, n, col int) ([][2]int, int) {
+	var elements [][2]int
+	depth := 0
+	next := false // the next value starts an element
+	quote := ""
+	for ; n < len(lines); n, col = n+1, 0 {
+		line := lines[n]
+		for i := col; i < len(line); i++ {
+			c := line[i]
+			if quote != "" {
+				if strings.HasPrefix(line[i:], quote) {
+					i += len(quote) - 1
+					quote = ""
+				} else if c == '\\' && quote[0] == '"' {
+					i++
+				}
+				continue
+			}
+			if next && depth == 1 && !strings.ContainsRune(" \t\r#,]", rune(c)) {
+				elements = append(elements, [2]int{n + 1, i + 1})
+				next = false
+			}
+			switch c {
+			case '#':
+				i = len(line)
+			case ',':
+				next = depth == 1
+			case '[', '{':
+				depth++
+				next = depth == 1
+			case ']', '}':
+				depth--
+				if depth == 0 {
+					return elements, n
+				}
+			case '"', '\'':
+				quote = string(c)
+				if triple := strings.Repeat(quote, 3); strings.HasPrefix(line[i:], triple) {
+					quote = triple
+					i += 2
+				}
+			}
+		}
+	}
+	return elements, len(lines) - 1
+}
+
+func keyParts(dotted string) []string {
+	parts := tomlPartRe.FindAllString(dotted, -1)
+	for i, p := range parts {
+		if len(p) >= 2 && (p[0] == '"' || p[0] == '\'') {
+			parts[i] = p[1 : len(p)-1]
+		}
+	}
+	return parts
+}
+
+func joinKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// keyPosition finds a problem key in the scanned keys. Keys set in inline
+// tables fall back to the nearest enclosing key that is written out in the
+// file.
+func keyPosition(keys []tomlKey, key string) (int, int) {
+	for key != "" {
+		for _, k := range keys {
+			if k.indexed == key {
+				return k.line, k.col
+			}
+		}
+		if i := strings.LastIndexAny(key, ".["); i > 0 {
+			key = key[:i]
+		} else {
+			break
+		}
+	}
+	return 0, 0
+}
+
+// problemStrings renders problems for Filter.Problems.
+func problemStrings(problems []filterProblem) []string {
+	out := make([]string, len(problems))
+	for i, p := range problems {
+		out[i] = p.String()
+	}
+	return out
+}
+
+// warnFilterProblems prints a one-line warning on stderr when the filter
+// about to run has rules that are being ignored.
+func warnFilterProblems(f *Filter) {
+	if f == nil || len(f.Problems) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("rt: warning: filter %s: %s (ignored)", f.Name, f.Problems[0])
+	if n := len(f.Problems) - 1; n > 0 {
+		msg += fmt.Sprintf(", and %d more", n)
+	}
+	if f.Source == "user" {
+		msg += fmt.Sprintf("; see `rt check %s`", f.Path)
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFilterJSONPaths(t *testing.T) {
+	data := `command = "kubectl get pods -o json"
+
+[json]
+root = ".items[="
+fields = [".metadata.name", "phase=.status."]
+format = "csv"
+`
+	_, problems, err := decodeFilter([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := problemStrings(problems)
+	want := []string{
+		`4:1: json.root: invalid path: unclosed '[' in path ".items[="`,
+		`5:29: json.fields[1]: invalid path: empty key in path ".status."`,
+		`6:1: json.format: unknown format "csv" (known: json, tsv)`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestDecodeFilterStreamTail(t *testing.T) {
+	data := `command = "cargo build"
+stream = true
+
+[on_success]
+output = "{output}"
+
+[on_failure]
+tail = 30
+`
+	_, problems, err := decodeFilter([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := problemStrings(problems)
+	want := []string{"8:1: on_failure.tail: has no effect with stream = true"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestDecodeFilterStreams(t *testing.T) {
+	data := `command = "make"
+streams = "sterr"
+`
+	_, problems, err := decodeFilter([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := problemStrings(problems)
+	want := []string{`2:1: streams: unknown value "sterr" (known: both, stderr, stdout)`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestDecodeFilterBlockUnknownKeys(t *testing.T) {
+	data := `command = "go test ./..."
+
+[diagnostics]
+per_file = 5
+per_fil = 3
+
+[on_failure]
+test_report = { format = "go", max_ouput = 5 }
+`
+	f, problems, err := decodeFilter([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := problemStrings(problems)
+	want := []string{
+		"5:1: diagnostics.per_fil: unknown key",
+		"8:1: on_failure.test_report.max_ouput: unknown key",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems:\n got %q\nwant %q", got, want)
+	}
+	if f.Diagnostics.PerFile != 5 || f.OnFailure.TestReport.Format != "go" {
+		t.Errorf("known keys not decoded: %+v, %+v", f.Diagnostics, *f.OnFailure.TestReport)
+	}
+}
+
+func TestScanTOMLKeys(t *testing.T) {
+	data := `command = "x"
+skip = [
+  "ok",  # "a, comment", [x]
+  'a,b',
+  "(bad",
+]
+keep = ["x", "[y"]
+run = """
+skip = "not a key"
+"""
+
+[[section]]
+start = "^a"
+
+[[section]]
+start = "^b"
+replace = [{ pattern = "p", output = "o" }]
+[on_failure]
+tail = 3
+`
+	var got []string
+	for _, k := range scanTOMLKeys([]byte(data)) {
+		got = append(got, fmt.Sprintf("%s %q %d:%d", k.indexed, k.plain, k.line, k.col))
+	}
+	want := []string{
+		`command "command" 1:1`,
+		`skip "skip" 2:1`,
+		`skip[0] "" 3:3`,
+		`skip[1] "" 4:3`,
+		`skip[2] "" 5:3`,
+		`keep "keep" 7:1`,
+		`keep[0] "" 7:9`,
+		`keep[1] "" 7:14`,
+		`run "run" 8:1`,
+		`section[0] "section" 12:1`,
+		`section[0].start "section.start" 13:1`,
+		`section[1] "section" 15:1`,
+		`section[1].start "section.start" 16:1`,
+		`section[1].replace "section.replace" 17:1`,
+		`section[1].replace[0] "" 17:12`,
+		`on_failure "on_failure" 18:1`,
+		`on_failure.tail "on_failure.tail" 19:1`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("keys:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestKeyPosition(t *testing.T) {
+	keys := scanTOMLKeys([]byte(`skip = [
+  "a",
+  "(b",
+]
+keep_context = { before = 2 }
+[[replace]]
+pattern = "x"
+`))
+	tests := []struct {
+		key       string
+		line, col int
+	}{
+		{"skip[1]", 3, 3},
+		{"skip", 1, 1},
+		{"skip[7]", 1, 1}, // not in the file: the enclosing key
+		{"keep_context.before", 5, 1},
+		{"replace[0].pattern", 7, 1},
+		{"replace[0].output", 6, 1},
+		{"table.header", 0, 0},
+	}
+	for _, tt := range tests {
+		line, col := keyPosition(keys, tt.key)
+		if line != tt.line || col != tt.col {
+			t.Errorf("keyPosition(%q) = %d:%d, want %d:%d", tt.key, line, col, tt.line, tt.col)
+		}
+	}
+}
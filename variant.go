@@ -0,0 +1,247 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxVariantDepth bounds variant chains (a child may declare its own variants)
+// so a cycle between filters can't loop forever.
+const maxVariantDepth = 8
+
+// variantContext is what variant detection rules are evaluated against.
+type variantContext struct {
+	Dir       string // working directory the command runs in
+	Command   string // full command string as given to rt
+	Output    string // raw output; only meaningful when HasOutput is set
+	HasOutput bool
+}
+
+// newVariantContext builds the pre-run context for a command string.
+func newVariantContext(cmdStr string) variantContext {
+	return variantContext{
+		Dir:     commandWorkDir(cmdStr),
+		Command: cmdStr,
+	}
+}
+
+// resolveVariant follows [[variant]] delegation starting at f and returns the
+// filter that should handle the command. Variants are tried in file order; the
+// first whose detection rules all pass wins, and its child filter is resolved
+// again in turn. Returns f itself when nothing matches.
+//
+// Before the command runs (HasOutput unset) variants using detect.output_contains
+// never match; resolveAfterRun gives them a chance.
+func resolveVariant(filters []Filter, f *Filter, ctx variantContext) *Filter {
+	for depth := 0; f != nil && depth < maxVariantDepth; depth++ {
+		child := matchVariant(filters, f, ctx)
+		if child == nil {
+			return f
+		}
+		f = child
+	}
+	return f
+}
+
+// resolveAfterRun resolves matched's variants again once the output is
+// known. It starts over from matched, not from the variant picked before the
+// run, so an output_contains variant declared first still wins.
+func resolveAfterRun(filters []Filter, matched *Filter, ctx variantContext, output string) *Filter {
+	ctx.Output, ctx.HasOutput = output, true
+	return resolveVariant(filters, matched, ctx)
+}
+
+func matchVariant(filters []Filter, f *Filter, ctx variantContext) *Filter {
+	for _, v := range f.Variants {
+		if !v.Detect.matches(ctx) {
+			continue
+		}
+		if child := findFilter(filters, v.Filter); child != nil && child.Name != f.Name {
+			return child
+		}
+	}
+	return nil
+}
+
+// findFilter looks up a filter by name, e.g. "npm/test-vitest".
+func findFilter(filters []Filter, name string) *Filter {
+	for i := range filters {
+		if filters[i].Name == name {
+			return &filters[i]
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether no detection rule is set.
+func (d VariantDetect) isEmpty() bool {
+	return len(d.Files) == 0 && len(d.Env) == 0 && len(d.CommandContains) == 0 &&
+		len(d.OutputContains) == 0 && len(d.FileContains) == 0
+}
+
+// matches reports whether every configured rule passes. Within one rule any
+// entry is enough (files = ["a", "b"] means a OR b); rules combine with AND.
+// A variant with no rules never matches.
+func (d VariantDetect) matches(ctx variantContext) bool {
+	if d.isEmpty() {
+		return false
+	}
+
+	if len(d.Files) > 0 && !anyOf(d.Files, func(p string) bool {
+		_, err := os.Stat(resolvePath(ctx.Dir, p))
+		return err == nil
+	}) {
+		return false
+	}
+
+	if len(d.Env) > 0 && !anyOf(d.Env, envMatches) {
+		return false
+	}
+
+	if len(d.CommandContains) > 0 && !anyOf(d.CommandContains, func(s string) bool {
+		return strings.Contains(ctx.Command, s)
+	}) {
+		return false
+	}
+
+	if len(d.FileContains) > 0 {
+		found := false
+		for path, needle := range d.FileContains {
+			data, err := os.ReadFile(resolvePath(ctx.Dir, path))
+			if err == nil && strings.Contains(string(data), needle) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(d.OutputContains) > 0 {
+		if !ctx.HasOutput || !anyOf(d.OutputContains, func(s string) bool {
+			return strings.Contains(ctx.Output, s)
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// envMatches checks "NAME" (set and non-empty) or "NAME=value" (exact value).
+func envMatches(rule string) bool {
+	if name, want, ok := strings.Cut(rule, "="); ok {
+		got, set := os.LookupEnv(name)
+		return set && got == want
+	}
+	return os.Getenv(rule) != ""
+}
+
+func anyOf(items []string, pred func(string) bool) bool {
+	for _, it := range items {
+		if pred(it) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolvePath(dir, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+// workDir is the directory the filtered command runs in, as computed by
+// commandWorkDir. Paths in its output (project frames, relpath) are relative
+// to it. Empty means rt's own working directory.
+var workDir string
+
+// outputDir returns workDir, falling back to rt's working directory.
+func outputDir() string {
+	if workDir != "" {
+		return workDir
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	return dir
+}
+
+// commandWorkDir returns the directory the last segment of a chained command
+// will run in, honoring leading "cd X &&" steps.
+// e.g. "cd web && npm test" run from /repo → /repo/web
+func commandWorkDir(cmdStr string) string {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = "."
+	}
+
+	prefix := chainPrefix(cmdStr)
+	if prefix == "" {
+		return dir
+	}
+
+	for _, seg := range splitChain(prefix) {
+		args := shellSplit(strings.TrimSpace(seg))
+		if len(args) == 0 || args[0] != "cd" {
+			continue
+		}
+		target := ""
+		if len(args) > 1 {
+			target = args[1]
+		}
+		switch {
+		case target == "" || target == "~":
+			dir = os.Getenv("HOME")
+		case target == "-":
+			// previous directory is unknown here; leave dir unchanged
+		case strings.HasPrefix(target, "~/"):
+			dir = filepath.Join(os.Getenv("HOME"), target[2:])
+		default:
+			dir = resolvePath(dir, target)
+		}
+	}
+	return dir
+}
+
+// splitChain splits a command on the chain operators used by chainPrefix.
+func splitChain(cmdStr string) []string {
+	var segs []string
+	rest := cmdStr
+	for {
+		best := -1
+		bestLen := 0
+		for _, sep := range []string{" && ", " || ", "; "} {
+			if idx := strings.Index(rest, sep); idx >= 0 && (best < 0 || idx < best) {
+				best = idx
+				bestLen = len(sep)
+			}
+		}
+		if best < 0 {
+			break
+		}
+		segs = append(segs, rest[:best])
+		rest = rest[best+bestLen:]
+	}
+	if strings.TrimSpace(rest) != "" {
+		segs = append(segs, rest)
+	}
+	return segs
+}
+
+// missingVariantTargets returns the child filter names referenced by f's
+// variants that are not present in filters.
+func missingVariantTargets(filters []Filter, f *Filter) []string {
+	var missing []string
+	for _, v := range f.Variants {
+		if findFilter(filters, v.Filter) == nil {
+			missing = append(missing, v.Filter)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveAfterRun(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "jest.config.js"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	filters := []Filter{
+		{Name: "npm/test", Variants: []Variant{
+			{Name: "vitest", Detect: VariantDetect{OutputContains: []string{"RUN  v"}}, Filter: "npm/test-vitest"},
+			{Name: "jest", Detect: VariantDetect{Files: []string{"jest.config.js"}}, Filter: "npm/test-jest"},
+		}},
+		{Name: "npm/test-vitest"},
+		{Name: "npm/test-jest"},
+	}
+	parent := &filters[0]
+	ctx := variantContext{Dir: dir, Command: "npm test"}
+
+	if got := resolveVariant(filters, parent, ctx); got.Name != "npm/test-jest" {
+		t.Fatalf("before the run: %s; want npm/test-jest", got.Name)
+	}
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{" RUN  v1.6.0 /repo\n ✓ src/cart.test.ts (3)\n", "npm/test-vitest"},
+		{"PASS src/cart.test.js\n", "npm/test-jest"},
+	}
+	for _, tt := range tests {
+		if got := resolveAfterRun(filters, parent, ctx, tt.output); got.Name != tt.want {
+			t.Errorf("resolveAfterRun(%q) = %s; want %s", tt.output, got.Name, tt.want)
+		}
+	}
+}